@@ -0,0 +1,154 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUpdateInterval = time.Millisecond * 10
+
+	// the number of packets Start() queues up before the reader waits
+	receiveQueueSize = 64
+)
+
+// Start runs the connection in the background instead of having it polled
+// with Tick(). One goroutine blocks reading the Socket and another resends
+// handshake and reliable packets, sends keepalives and checks for timeouts
+// every UpdateInterval. Packets read are sent on the channel returned unless
+// OnPacketRead is set, in which case they're only passed to that event.
+// Everything stops and the channel is closed when the context is cancelled
+// or the connection is closed. Tick() and Read() shouldn't be called while
+// the connection is running in the background.
+func (c *Connection) Start(ctx context.Context) (<-chan *Packet, error) {
+	if c.server != nil {
+		return nil, fmt.Errorf("Peers of a Server are read by the Server.")
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+	if !c.isOpen {
+		return nil, fmt.Errorf("The connection is not open.")
+	}
+	if c.stopBackground != nil {
+		return nil, fmt.Errorf("The connection has already been started.")
+	}
+
+	ctx, c.stopBackground = context.WithCancel(ctx)
+	update := func() {
+		c.mu.Lock()
+		c.update()
+		c.unlock()
+	}
+	stopped := func() {
+		c.mu.Lock()
+		c.stopBackground = nil
+		c.unlock()
+	}
+	return runBackground(ctx, c.Socket, c.updateInterval(), c.Read, update, c.OnPacketRead == nil, stopped), nil
+}
+
+func (c *Connection) updateInterval() time.Duration {
+	if c.UpdateInterval > 0 {
+		return c.UpdateInterval
+	}
+	return defaultUpdateInterval
+}
+
+// Start runs the Server in the background instead of having it polled with
+// Tick(), the same way Connection.Start() does. Packets read from every peer
+// are sent on the channel returned unless OnPacketRead is set; the peer a
+// packet came from can be found with GetPeer(p.RemoteAddress).
+func (s *Server) Start(ctx context.Context) (<-chan *Packet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isOpen {
+		return nil, fmt.Errorf("The server is not open.")
+	}
+	if s.stopBackground != nil {
+		return nil, fmt.Errorf("The server has already been started.")
+	}
+
+	ctx, s.stopBackground = context.WithCancel(ctx)
+	read := func() (*Packet, error) {
+		_, p, err := s.Read()
+		return p, err
+	}
+	update := func() {
+		s.updatePeers()
+	}
+	stopped := func() {
+		s.mu.Lock()
+		s.stopBackground = nil
+		s.mu.Unlock()
+	}
+	interval := s.UpdateInterval
+	if interval <= 0 {
+		interval = defaultUpdateInterval
+	}
+	return runBackground(ctx, s.Socket, interval, read, update, s.OnPacketRead == nil, stopped), nil
+}
+
+// runBackground starts the reader and update goroutines behind Start() and
+// returns the channel packets are delivered on. Once ctx is done, the
+// blocked read is woken by moving the socket's read deadline to now; after
+// both goroutines return the deadline is cleared, stopped is called and the
+// channel is closed.
+func runBackground(ctx context.Context, socket net.PacketConn, interval time.Duration,
+	read func() (*Packet, error), update func(), deliver bool, stopped func()) <-chan *Packet {
+	packets := make(chan *Packet, receiveQueueSize)
+
+	// reads block until a packet arrives, so clear any deadline left by Tick()
+	socket.SetReadDeadline(time.Time{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			p, err := read()
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil || !deliver {
+				continue
+			}
+			select {
+			case packets <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				update()
+			}
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		socket.SetReadDeadline(time.Now())
+		wg.Wait()
+		socket.SetReadDeadline(time.Time{})
+		stopped()
+		close(packets)
+	}()
+
+	return packets
+}
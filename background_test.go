@@ -0,0 +1,136 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	backgroundTestPort = 42085
+)
+
+func TestBackground(t *testing.T) {
+	server, err := NewServer(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", backgroundTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.KeepAliveInterval = time.Millisecond * 20
+
+	client, err := NewConnection(serverTestBufferSize, "", fmt.Sprintf("127.0.0.1:%d", backgroundTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serverPackets, err := server.Start(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start the server.\n%v", err)
+	}
+	if _, err := server.Start(ctx); err == nil {
+		t.Errorf("Starting the server twice should fail.")
+	}
+	clientPackets, err := client.Start(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start the client.\n%v", err)
+	}
+
+	// the acks come back in the server's keepalives, which only get sent
+	// if its update goroutine is running
+	acked := make(chan bool, 1)
+	testPayload := []byte("PING")
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Millisecond*100, 5)
+	rp.OnAck = func(c *Connection, rp *ReliablePacket) {
+		acked <- true
+	}
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+
+	select {
+	case p := <-serverPackets:
+		if string(p.Payload[:p.PayloadSize]) != string(testPayload) {
+			t.Errorf("Server read %q instead of %q.", p.Payload[:p.PayloadSize], testPayload)
+		}
+		peer := server.GetPeer(p.RemoteAddress)
+		if peer == nil {
+			t.Fatalf("Server has no peer for %v.", p.RemoteAddress)
+		}
+
+		pong := []byte("PONG")
+		err = peer.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(pong)), pong), true, nil)
+		if err != nil {
+			t.Fatalf("Server failed to send data.\n%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Server didn't read the packet in the background.")
+	}
+
+	select {
+	case p := <-clientPackets:
+		if string(p.Payload[:p.PayloadSize]) != "PONG" {
+			t.Errorf("Client read %q instead of PONG.", p.Payload[:p.PayloadSize])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Client didn't read the reply in the background.")
+	}
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatalf("Client's reliable packet was never acked.")
+	}
+
+	// cancelling the context stops everything and closes the channels
+	cancel()
+	for _, packets := range []<-chan *Packet{serverPackets, clientPackets} {
+		select {
+		case _, ok := <-packets:
+			if ok {
+				t.Errorf("No more packets should have been delivered.")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("The channel wasn't closed after the context was cancelled.")
+		}
+	}
+
+	// the connection can be polled again once it has stopped
+	client.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if _, err := client.Read(); err == nil {
+		t.Errorf("Client shouldn't have anything left to read.")
+	}
+}
+
+func TestBackgroundClose(t *testing.T) {
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", backgroundTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+
+	packets, err := client.Start(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start the client.\n%v", err)
+	}
+
+	// closing the connection ends the background goroutines too
+	client.Close()
+	select {
+	case _, ok := <-packets:
+		if ok {
+			t.Errorf("No packets should have been delivered.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("The channel wasn't closed after the connection was closed.")
+	}
+
+	if _, err := client.Start(context.Background()); err == nil {
+		t.Errorf("Starting a closed connection should fail.")
+	}
+}
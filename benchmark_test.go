@@ -0,0 +1,102 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+var (
+	benchmarkPort = 42095
+)
+
+// benchmarkPair makes two connections talking to each other over the UDP
+// loopback.
+func benchmarkPair(b *testing.B) (*Connection, *Connection) {
+	listener, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", benchmarkPort), "")
+	if err != nil {
+		b.Fatalf("Failed to create the listener.\n%v", err)
+	}
+	client, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", benchmarkPort+1), fmt.Sprintf("127.0.0.1:%d", benchmarkPort))
+	if err != nil {
+		listener.Close()
+		b.Fatalf("Failed to create the client.\n%v", err)
+	}
+	return listener, client
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	payload := make([]byte, 512)
+	p := NewPacket(42, 1, 0, 0, 0, uint32(len(payload)), payload)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := p.WriteTo(&buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkAppendBinary(b *testing.B) {
+	payload := make([]byte, 512)
+	p := NewPacket(42, 1, 0, 0, 0, uint32(len(payload)), payload)
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.AppendBinary(buf[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePacket(b *testing.B) {
+	encoded := encodePacket(b, 0, 0, make([]byte, 512))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p, err := DecodePacket(encoded, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ReleasePacket(p)
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	listener, client := benchmarkPair(b)
+	defer listener.Close()
+	defer client.Close()
+
+	payload := make([]byte, 512)
+	p := NewPacket(42, 0, 0, 0, 0, uint32(len(payload)), payload)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := client.Send(p, true, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSendRead sends a packet and reads it on the other side, releasing
+// what's read so that the reads can reuse the packets.
+func BenchmarkSendRead(b *testing.B) {
+	listener, client := benchmarkPair(b)
+	defer listener.Close()
+	defer client.Close()
+
+	payload := make([]byte, 512)
+	p := NewPacket(42, 0, 0, 0, 0, uint32(len(payload)), payload)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := client.Send(p, true, nil); err != nil {
+			b.Fatal(err)
+		}
+		read, err := listener.Read()
+		if err != nil {
+			b.Fatal(err)
+		}
+		ReleasePacket(read)
+	}
+}
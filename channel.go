@@ -0,0 +1,319 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeliveryMode describes the guarantees a channel gives the packets sent on it.
+// Both sides of a connection need to configure the same modes for their channels.
+type DeliveryMode uint8
+
+const (
+	// Unreliable packets may be lost, duplicated or arrive out of order. This
+	// is the default for every channel.
+	Unreliable DeliveryMode = iota
+
+	// UnreliableSequenced packets may be lost, but a packet older than the
+	// newest one already read on the channel is dropped.
+	UnreliableSequenced
+
+	// ReliableUnordered packets are resent until acknowledged, but may be
+	// read in any order.
+	ReliableUnordered
+
+	// ReliableOrdered packets are resent until acknowledged and are read in
+	// the order they were sent; packets that arrive early are held until the
+	// gap before them is filled.
+	ReliableOrdered
+)
+
+// MaxChannel is the highest channel number available to applications. The
+// high bit of the channel byte on the wire marks a packet carrying a message
+// id, so versions of this package from before channels had delivery modes
+// can't talk to this one on channels above MaxChannel.
+const MaxChannel = ControlChannel - 1
+
+const (
+	defaultOrderedGapTimeout = time.Second * 5
+)
+
+// channel tracks the delivery state for one channel of a connection.
+type channel struct {
+	mode DeliveryMode
+
+	// the message id for the next packet sent on the channel
+	nextMsgId uint32
+
+	// the newest message id read on a sequenced channel
+	lastMsgId uint32
+	gotMsg    bool
+
+	// the next message id to deliver on an ordered channel, the packets
+	// that arrived ahead of it and when the gap before them opened
+	expectedMsgId uint32
+	held          map[uint32]*Packet
+	gapStarted    time.Time
+
+	// the message ids recently read on the channel
+	seen dupeWindow
+
+	// the newest message id read on the channel in any mode
+	newestMsgId uint32
+	gotNewest   bool
+}
+
+func (m DeliveryMode) String() string {
+	switch m {
+	case Unreliable:
+		return "unreliable"
+	case UnreliableSequenced:
+		return "unreliable sequenced"
+	case ReliableUnordered:
+		return "reliable unordered"
+	case ReliableOrdered:
+		return "reliable ordered"
+	}
+	return fmt.Sprintf("mode(%d)", uint8(m))
+}
+
+// isReliable returns true for modes where packets are resent until acknowledged.
+func (m DeliveryMode) isReliable() bool {
+	return m == ReliableUnordered || m == ReliableOrdered
+}
+
+// SetChannelMode sets the delivery mode for the channel ch. Packets sent with
+// Send() on a reliable channel are automatically tracked as ReliablePackets
+// using ReliableRetryInterval and ReliableRetryCount. The mode can't be
+// changed once packets with message ids have been sent or read on the
+// channel, since the remote side would misread the ones that follow.
+func (c *Connection) SetChannelMode(ch uint8, mode DeliveryMode) error {
+	c.mu.Lock()
+	defer c.unlock()
+	if ch > MaxChannel {
+		return fmt.Errorf("Channel %d is out of range; the maximum is %d.", ch, MaxChannel)
+	}
+	if mode > ReliableOrdered {
+		return fmt.Errorf("Unknown delivery mode %d for channel %d.", mode, ch)
+	}
+
+	cs := c.channels[ch]
+	switch {
+	case cs == nil:
+		c.getChannel(ch).mode = mode
+	case cs.mode != mode && cs.inUse():
+		return fmt.Errorf("Channel %d can't change from %v to %v once it has been used.", ch, cs.mode, mode)
+	default:
+		cs.mode = mode
+	}
+	return nil
+}
+
+// GetChannelMode returns the delivery mode for the channel ch.
+func (c *Connection) GetChannelMode(ch uint8) DeliveryMode {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.channelMode(ch)
+}
+
+func (c *Connection) channelMode(ch uint8) DeliveryMode {
+	if cs := c.channels[ch]; cs != nil {
+		return cs.mode
+	}
+	return Unreliable
+}
+
+// getChannel returns the state for the channel ch, creating it if needed.
+func (c *Connection) getChannel(ch uint8) *channel {
+	cs := c.channels[ch]
+	if cs == nil {
+		if c.channels == nil {
+			c.channels = make(map[uint8]*channel)
+		}
+		cs = &channel{mode: Unreliable}
+		c.channels[ch] = cs
+	}
+	return cs
+}
+
+// inUse returns true if packets with message ids have been sent or read on
+// the channel.
+func (cs *channel) inUse() bool {
+	return cs.nextMsgId != 0 || cs.gotMsg || cs.expectedMsgId != 0 || len(cs.held) > 0 || cs.seen.started
+}
+
+// checkRestart starts the receive state of the packet's channel over if its
+// message id is further behind the newest one read than a resend could be.
+// That happens when a remote side without a session restarts and numbers
+// its messages from 0 again; otherwise its packets would be acked and then
+// dropped as duplicates or as stale. A restart on a channel that hasn't read
+// a duplicate window's worth of messages can't be told apart from resends.
+func (c *Connection) checkRestart(p *Packet) {
+	if !p.hasMsgId {
+		return
+	}
+	cs := c.getChannel(p.Chan)
+	if cs.gotNewest && !seqGreaterThan(p.MsgId, cs.newestMsgId) && cs.newestMsgId-p.MsgId >= dupeWindowSize {
+		for _, held := range cs.held {
+			ReleasePacket(held)
+		}
+		*cs = channel{mode: cs.mode, nextMsgId: cs.nextMsgId}
+	}
+	if !cs.gotNewest || seqGreaterThan(p.MsgId, cs.newestMsgId) {
+		cs.newestMsgId = p.MsgId
+		cs.gotNewest = true
+	}
+}
+
+// resetChannels forgets the send and receive state of every channel while
+// keeping their modes.
+func (c *Connection) resetChannels() {
+	for ch, cs := range c.channels {
+		c.channels[ch] = &channel{mode: cs.mode}
+	}
+	c.pending.Init()
+}
+
+// assignMsgId gives the packet the next message id for its channel if the
+// channel needs one or if the packet is going to be sent reliably, so that
+// the remote side can recognize resent copies.
+func (c *Connection) assignMsgId(p *Packet, reliable bool) {
+	if !reliable && c.channelMode(p.Chan) == Unreliable {
+		p.hasMsgId = false
+		return
+	}
+
+	cs := c.getChannel(p.Chan)
+	p.MsgId = cs.nextMsgId
+	p.hasMsgId = true
+	cs.nextMsgId++
+}
+
+// receiveOnChannel applies the delivery mode of the packet's channel. It
+// returns false if the packet shouldn't be delivered right now. Packets
+// held on an ordered channel that become deliverable are queued in pending.
+func (c *Connection) receiveOnChannel(p *Packet) bool {
+	cs := c.channels[p.Chan]
+	if cs == nil || !p.hasMsgId {
+		return true
+	}
+
+	switch cs.mode {
+	case UnreliableSequenced:
+		if cs.gotMsg && !seqGreaterThan(p.MsgId, cs.lastMsgId) {
+			return false
+		}
+		cs.lastMsgId = p.MsgId
+		cs.gotMsg = true
+		return true
+
+	case ReliableOrdered:
+		if seqGreaterThan(cs.expectedMsgId, p.MsgId) {
+			return false
+		}
+		if p.MsgId == cs.expectedMsgId {
+			// this fills the gap, so release anything held right behind it
+			cs.expectedMsgId++
+			cs.gapStarted = time.Time{}
+			c.releaseHeld(cs)
+			return true
+		}
+
+		// only the duplicate window's worth of packets is held, so one
+		// further ahead gives up on the oldest of the missing ones
+		if p.MsgId-cs.expectedMsgId >= dupeWindowSize {
+			c.skipOrdered(cs, p.MsgId-dupeWindowSize+1)
+		}
+		if cs.held == nil {
+			cs.held = make(map[uint32]*Packet)
+		}
+		cs.held[p.MsgId] = p
+		c.releaseHeld(cs)
+		return false
+	}
+
+	return true
+}
+
+// releaseHeld queues the packets held on the ordered channel that are next
+// in line to be delivered.
+func (c *Connection) releaseHeld(cs *channel) {
+	for {
+		next, ok := cs.held[cs.expectedMsgId]
+		if !ok {
+			break
+		}
+		delete(cs.held, cs.expectedMsgId)
+		c.pending.PushBack(next)
+		cs.expectedMsgId++
+	}
+
+	switch {
+	case len(cs.held) == 0:
+		cs.gapStarted = time.Time{}
+	case cs.gapStarted.IsZero():
+		cs.gapStarted = c.now()
+	}
+}
+
+// skipOrdered gives up on the missing packets of the ordered channel before
+// the message id upTo, releasing the held packets in between.
+func (c *Connection) skipOrdered(cs *channel, upTo uint32) {
+	// everything held is within the duplicate window of the expected id
+	for i := 0; i < dupeWindowSize && seqGreaterThan(upTo, cs.expectedMsgId); i++ {
+		if next, ok := cs.held[cs.expectedMsgId]; ok {
+			delete(cs.held, cs.expectedMsgId)
+			c.pending.PushBack(next)
+		} else {
+			c.stats.OrderedSkipped++
+		}
+		cs.expectedMsgId++
+	}
+	if seqGreaterThan(upTo, cs.expectedMsgId) {
+		c.stats.OrderedSkipped += uint64(upTo - cs.expectedMsgId)
+		cs.expectedMsgId = upTo
+	}
+
+	cs.gapStarted = time.Time{}
+	c.releaseHeld(cs)
+}
+
+// expireOrderedGaps skips past the missing packets of ordered channels that
+// have been holding packets longer than OrderedGapTimeout.
+func (c *Connection) expireOrderedGaps() {
+	if c.OrderedGapTimeout <= 0 {
+		return
+	}
+
+	t := c.now()
+	for _, cs := range c.channels {
+		if len(cs.held) == 0 || t.Sub(cs.gapStarted) < c.OrderedGapTimeout {
+			continue
+		}
+
+		// skip up to the oldest packet that did arrive
+		var first uint32
+		found := false
+		for msgId := range cs.held {
+			if !found || seqGreaterThan(first, msgId) {
+				first = msgId
+				found = true
+			}
+		}
+		c.skipOrdered(cs, first)
+	}
+}
+
+// popPending returns the next packet released from an ordered channel, or
+// nil if there isn't one.
+func (c *Connection) popPending() *Packet {
+	e := c.pending.Front()
+	if e == nil {
+		return nil
+	}
+	c.pending.Remove(e)
+	return e.Value.(*Packet)
+}
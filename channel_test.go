@@ -0,0 +1,219 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	channelTestPort = 42025
+)
+
+func newChannelTestPacket(ch uint8, msgId uint32) *Packet {
+	testPayload := []byte(fmt.Sprintf("MSG%d", msgId))
+	p := NewPacket(42, 0, ch, 0, 0, uint32(len(testPayload)), testPayload)
+	p.MsgId = msgId
+	p.hasMsgId = true
+	return p
+}
+
+func TestMsgIdEncoding(t *testing.T) {
+	p := newChannelTestPacket(3, 1234)
+
+	var buf bytes.Buffer
+	err := p.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("Failed to write the packet.\n%v", err)
+	}
+
+	p2, err := NewPacketFrom(buf.Len(), buf.Bytes())
+	if err != nil {
+		t.Fatalf("Failed to read the packet back.\n%v", err)
+	}
+	if !p2.HasMsgId() || p2.MsgId != 1234 || p2.Chan != 3 {
+		t.Errorf("Packet read back with chan %d, msg id %d (%v).", p2.Chan, p2.MsgId, p2.HasMsgId())
+	}
+	if string(p2.Payload[:p2.PayloadSize]) != "MSG1234" {
+		t.Errorf("Packet read back with the wrong payload: %q", string(p2.Payload[:p2.PayloadSize]))
+	}
+}
+
+func TestSequencedChannel(t *testing.T) {
+	c := New(0)
+	c.SetChannelMode(1, UnreliableSequenced)
+
+	tests := []struct {
+		msgId   uint32
+		deliver bool
+	}{
+		{0, true},
+		{2, true},
+		{1, false},
+		{2, false},
+		{5, true},
+	}
+	for _, test := range tests {
+		if c.receiveOnChannel(newChannelTestPacket(1, test.msgId)) != test.deliver {
+			t.Errorf("Sequenced channel should deliver msg %d: %v", test.msgId, test.deliver)
+		}
+	}
+}
+
+func TestOrderedChannel(t *testing.T) {
+	c := New(0)
+	c.SetChannelMode(2, ReliableOrdered)
+
+	// packets 1 and 2 arrive before 0
+	if c.receiveOnChannel(newChannelTestPacket(2, 2)) || c.receiveOnChannel(newChannelTestPacket(2, 1)) {
+		t.Fatalf("Ordered channel delivered a packet ahead of a gap.")
+	}
+	if c.popPending() != nil {
+		t.Fatalf("Ordered channel released a packet ahead of a gap.")
+	}
+	if !c.receiveOnChannel(newChannelTestPacket(2, 0)) {
+		t.Fatalf("Ordered channel didn't deliver the packet filling the gap.")
+	}
+	for i := uint32(1); i <= 2; i++ {
+		p := c.popPending()
+		if p == nil || p.MsgId != i {
+			t.Fatalf("Ordered channel should have released msg %d next but got %v.", i, p)
+		}
+	}
+	if c.popPending() != nil {
+		t.Errorf("Ordered channel released too many packets.")
+	}
+
+	// old packets don't come back
+	if c.receiveOnChannel(newChannelTestPacket(2, 1)) {
+		t.Errorf("Ordered channel delivered an old packet again.")
+	}
+
+	// other channels aren't affected
+	if !c.receiveOnChannel(newChannelTestPacket(3, 7)) {
+		t.Errorf("Unreliable channel didn't deliver a packet.")
+	}
+}
+
+func TestReliableChannelSend(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", channelTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	server.SetChannelMode(1, ReliableOrdered)
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", channelTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.SetChannelMode(1, ReliableOrdered)
+
+	for i := 0; i < 3; i++ {
+		testPayload := []byte(fmt.Sprintf("MSG%d", i))
+		err = client.Send(NewPacket(42, 0, 1, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+		if err != nil {
+			t.Fatalf("Client failed to send data.\n%v", err)
+		}
+	}
+	if client.GetAcksNeededLen() != 3 {
+		t.Errorf("Packets on a reliable channel should be waiting for acks (%d).", client.GetAcksNeededLen())
+	}
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		p, err := server.Read()
+		if err != nil {
+			t.Fatalf("Server failed to read data.\n%v", err)
+		}
+		if !p.HasMsgId() || p.MsgId != uint32(i) || string(p.Payload[:p.PayloadSize]) != fmt.Sprintf("MSG%d", i) {
+			t.Errorf("Server read msg %d with payload %q, expected %d.", p.MsgId, string(p.Payload[:p.PayloadSize]), i)
+		}
+	}
+
+	if err := client.SetChannelMode(ControlChannel, ReliableOrdered); err == nil {
+		t.Errorf("Setting the mode of the control channel should fail.")
+	}
+}
+
+// TestOrderedChannelGaps makes sure an ordered channel only holds a window's
+// worth of packets and skips a gap that's never going to be filled.
+func TestOrderedChannelGaps(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	c := New(0)
+	c.Clock = clock
+	c.SetChannelMode(2, ReliableOrdered)
+
+	// msg 0 never arrives, so 1 and 2 are held until the gap times out
+	c.receiveOnChannel(newChannelTestPacket(2, 1))
+	c.receiveOnChannel(newChannelTestPacket(2, 2))
+	clock.Advance(c.OrderedGapTimeout - time.Millisecond)
+	c.update()
+	if c.popPending() != nil {
+		t.Fatalf("Ordered channel skipped a gap before OrderedGapTimeout.")
+	}
+	clock.Advance(time.Millisecond)
+	c.update()
+	for i := uint32(1); i <= 2; i++ {
+		p := c.popPending()
+		if p == nil || p.MsgId != i {
+			t.Fatalf("Ordered channel should have released msg %d after the gap timed out but got %v.", i, p)
+		}
+	}
+	if c.GetStats().OrderedSkipped != 1 {
+		t.Errorf("Ordered channel should have skipped 1 packet but skipped %d.", c.GetStats().OrderedSkipped)
+	}
+
+	// a packet too far ahead to hold gives up on the oldest missing ones
+	c.receiveOnChannel(newChannelTestPacket(2, 5))
+	if c.receiveOnChannel(newChannelTestPacket(2, 4+dupeWindowSize)) {
+		t.Fatalf("Ordered channel delivered a packet ahead of a gap.")
+	}
+	if p := c.popPending(); p == nil || p.MsgId != 5 {
+		t.Fatalf("Ordered channel should have released msg 5 to make room but got %v.", p)
+	}
+	if c.popPending() != nil {
+		t.Errorf("Ordered channel released a packet that still has a gap in front of it.")
+	}
+	if held := len(c.channels[2].held); held != 1 {
+		t.Errorf("Ordered channel should be holding 1 packet but has %d.", held)
+	}
+	if c.GetStats().OrderedSkipped != 3 {
+		t.Errorf("Ordered channel should have skipped 3 packets but skipped %d.", c.GetStats().OrderedSkipped)
+	}
+}
+
+// TestChannelModeChange makes sure setting a channel's mode again keeps its
+// state and that a used channel can't switch to a different mode.
+func TestChannelModeChange(t *testing.T) {
+	c := New(0)
+	c.SetChannelMode(2, ReliableOrdered)
+	c.receiveOnChannel(newChannelTestPacket(2, 0))
+	c.receiveOnChannel(newChannelTestPacket(2, 2))
+	c.assignMsgId(newChannelTestPacket(2, 0), true)
+
+	if err := c.SetChannelMode(2, ReliableOrdered); err != nil {
+		t.Fatalf("Setting a channel to its current mode should succeed.\n%v", err)
+	}
+	cs := c.channels[2]
+	if cs.nextMsgId != 1 || cs.expectedMsgId != 1 || len(cs.held) != 1 {
+		t.Errorf("Setting the same mode reset the channel (next %d, expected %d, held %d).",
+			cs.nextMsgId, cs.expectedMsgId, len(cs.held))
+	}
+	if err := c.SetChannelMode(2, ReliableUnordered); err == nil {
+		t.Errorf("Changing the mode of a channel in use should fail.")
+	}
+
+	// packets without message ids don't count as using the channel
+	c.SetChannelMode(3, Unreliable)
+	c.assignMsgId(newChannelTestPacket(3, 0), false)
+	c.receiveOnChannel(NewPacket(42, 0, 3, 0, 0, 0, nil))
+	if err := c.SetChannelMode(3, ReliableUnordered); err != nil {
+		t.Errorf("Changing the mode of an unused channel should succeed.\n%v", err)
+	}
+}
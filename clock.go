@@ -0,0 +1,63 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time for the retry, timeout and
+// round-trip time logic of a Connection, Server, Banlist or RateLimiter.
+// A nil Clock uses the real time; a ManualClock lets tests step through
+// time instantly. Socket deadlines always use the real time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ManualClock is a Clock that only moves when it's told to. It's safe for
+// concurrent use.
+type ManualClock struct {
+	t  time.Time
+	mu sync.Mutex
+}
+
+// NewManualClock creates a ManualClock stopped at the time supplied.
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+// Now returns the clock's current time.
+func (m *ManualClock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.t
+}
+
+// Advance moves the clock forward by d.
+func (m *ManualClock) Advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.t = m.t.Add(d)
+}
+
+// Set moves the clock to the time supplied.
+func (m *ManualClock) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.t = t
+}
+
+// clockNow returns the time from the clock, or the real time if it's nil.
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+// now returns the current time from the connection's Clock.
+func (c *Connection) now() time.Time {
+	return clockNow(c.Clock)
+}
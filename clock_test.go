@@ -0,0 +1,160 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	clockTestStart = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// TestClockRetry steps a ManualClock through every resend of a reliable
+// packet that never gets acked, without waiting on the real time.
+func TestClockRetry(t *testing.T) {
+	network := NewMemoryNetwork()
+	receiver, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	clock := NewManualClock(clockTestStart)
+	client := NewTransportConnection(testServerBufferSize, clientConn, receiver.LocalAddr())
+	defer client.Close()
+	client.Clock = clock
+
+	failed := false
+	const retryInterval = time.Millisecond * 100
+	const retryCount = 5
+	testPayload := []byte("PING")
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(retryInterval, retryCount)
+	rp.OnFailToAck = func(c *Connection, rp *ReliablePacket) {
+		failed = true
+	}
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	if got := len(readAll(receiver, time.Millisecond)); got != 1 {
+		t.Fatalf("Receiver should have read the first send but read %d datagrams.", got)
+	}
+
+	for i := 1; i <= retryCount; i++ {
+		// nothing is resent until the full interval has passed
+		clock.Advance(retryInterval - time.Millisecond)
+		client.RetryReliablePackets()
+		if got := len(readAll(receiver, time.Millisecond)); got != 0 {
+			t.Fatalf("Retry %d was sent early.", i)
+		}
+
+		clock.Advance(time.Millisecond)
+		client.RetryReliablePackets()
+		if got := len(readAll(receiver, time.Millisecond)); got != 1 {
+			t.Fatalf("Retry %d should have sent 1 datagram but sent %d.", i, got)
+		}
+	}
+	if failed {
+		t.Errorf("OnFailToAck fired before the last retry's interval passed.")
+	}
+
+	clock.Advance(retryInterval)
+	client.RetryReliablePackets()
+	if !failed {
+		t.Errorf("OnFailToAck should have fired after %d retries.", retryCount)
+	}
+	if client.GetAcksNeededLen() != 0 {
+		t.Errorf("The failed packet should have stopped waiting on an ack.")
+	}
+}
+
+// TestClockTimeouts checks the handshake and idle timeouts with a ManualClock.
+func TestClockTimeouts(t *testing.T) {
+	network := NewMemoryNetwork()
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	nowhere := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	clock := NewManualClock(clockTestStart)
+	client := NewTransportConnection(testServerBufferSize, clientConn, nowhere)
+	defer client.Close()
+	client.Clock = clock
+
+	var rejectReason RejectReason
+	rejected := false
+	client.OnRejected = func(c *Connection, reason RejectReason) {
+		rejected, rejectReason = true, reason
+	}
+	err = client.Connect(nil)
+	if err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	clock.Advance(client.HandshakeTimeout - time.Millisecond)
+	client.Tick()
+	if rejected {
+		t.Fatalf("Handshake timed out early.")
+	}
+	clock.Advance(time.Millisecond)
+	client.Tick()
+	if !rejected || rejectReason != RejectTimeout {
+		t.Fatalf("Handshake should have timed out (rejected: %v, reason: %v).", rejected, rejectReason)
+	}
+
+	// without a handshake, the idle timer starts with the first send
+	idle := NewTransportConnection(testServerBufferSize, clientConn, nowhere)
+	idle.Clock = clock
+	idle.IdleTimeout = time.Minute
+	timedOut := false
+	idle.OnTimeout = func(c *Connection) {
+		timedOut = true
+	}
+	testPayload := []byte("PING")
+	err = idle.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil {
+		t.Fatalf("Failed to send data.\n%v", err)
+	}
+	clock.Advance(time.Minute - time.Millisecond)
+	idle.Tick()
+	if timedOut {
+		t.Fatalf("Connection timed out early.")
+	}
+	clock.Advance(time.Millisecond)
+	idle.Tick()
+	if !timedOut {
+		t.Errorf("Connection should have timed out after %v.", idle.IdleTimeout)
+	}
+}
+
+// TestClockFilters checks temporary bans and rate limits with a ManualClock.
+func TestClockFilters(t *testing.T) {
+	clock := NewManualClock(clockTestStart)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+	banlist := NewBanlist()
+	banlist.Clock = clock
+	banlist.Ban("10.0.0.1", time.Hour)
+	if banlist.Accept(addr) {
+		t.Errorf("Banned address was accepted.")
+	}
+	clock.Advance(time.Hour)
+	if !banlist.Accept(addr) {
+		t.Errorf("Address was still refused after its ban expired.")
+	}
+
+	limiter := NewRateLimiter(1, 0)
+	limiter.Clock = clock
+	if !limiter.Allow(addr, 10) || limiter.Allow(addr, 10) {
+		t.Fatalf("Rate limiter should allow only one packet a second.")
+	}
+	clock.Advance(time.Second)
+	if !limiter.Allow(addr, 10) {
+		t.Errorf("Rate limiter should have refilled after a second.")
+	}
+}
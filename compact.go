@@ -0,0 +1,387 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidHeader is returned when a compact header uses an encoding that
+// doesn't exist.
+var ErrInvalidHeader = errors.New("Packet header is invalid.")
+
+// The compact header starts with a flags byte saying which fields follow:
+//
+//	ClientId  uvarint, only until a packet carrying it has been acked
+//	Seq       the low 1, 2 or 4 bytes, picked by how far it's ahead of the
+//	          AckSeq in the remote side's packet that AckSeq acks
+//	Chan      1 byte, left out for channel 0
+//	AckSeq    the low 2 bytes, expanded to the latest matching sequence
+//	          number the receiver sent
+//	AckMask   all ones, or the uvarint of the mask or of its inverse
+//	MsgId     uvarint
+//
+// The payload is the rest of the datagram. The high bit of the flags is
+// always set. Compact headers are only sent and read once the handshake has
+// agreed on them, and from then on only handshake packets keep the full
+// header, which starts with a zero ClientId, so the two can't be mixed up.
+const (
+	compactMarker   uint8 = 0x80
+	compactClientId uint8 = 0x40
+	compactChan     uint8 = 0x20
+	compactMsgId    uint8 = 0x10
+
+	// bits 2 and 3 are the size code of the Seq field
+	compactSeqShift = 2
+	compactSeqMask  = 0x03
+
+	// bits 0 and 1 say how the ack fields are encoded
+	compactAckNone     uint8 = 0
+	compactAckAllOnes  uint8 = 1
+	compactAckMask     uint8 = 2
+	compactAckInverted uint8 = 3
+	compactAckBits     uint8 = 0x03
+)
+
+// compactSeqSizes are the Seq field sizes for each size code.
+var compactSeqSizes = [...]int{1, 2, 4}
+
+// compactBaseStep is how far the AckSeq of the packets sent moves on between
+// the ones kept in compactState.bases.
+const compactBaseStep = 1 << 6
+
+// compactBase is the AckSeq a packet was sent with.
+type compactBase struct {
+	seq    uint32
+	ackSeq uint32
+}
+
+// compactState is what both sides of a session track to shorten the
+// compact header.
+type compactState struct {
+	// sentSeq is the latest sequence number sent
+	sentSeq uint32
+
+	// recvSeq is the latest sequence number read from the remote side and
+	// recvAck the AckSeq that packet carried
+	recvSeq uint32
+	recvAck uint32
+
+	// bases keeps the AckSeq of a packet sent each time it has moved on by
+	// compactBaseStep, newest at baseIndex. A short Seq is expanded from the
+	// AckSeq of the packet the remote side acks in the same header, which is
+	// known from here to within compactBaseStep however late the packet is.
+	bases     [32]compactBase
+	baseCount int
+	baseIndex int
+
+	// sendId is the ClientId last sent; it's repeated in every packet while
+	// idPending is set and the latest packet carrying it was idSeq. recvId is
+	// the ClientId last read.
+	sendId    uint32
+	idPending bool
+	idSeq     uint32
+	recvId    uint32
+}
+
+// compactSession returns true if the handshake has agreed on compact
+// headers for the session.
+func (c *Connection) compactSession() bool {
+	return c.features&FeatureCompactHeaders != 0 && (c.state == StateChallenged || c.state == StateConnected)
+}
+
+// useCompactHeader returns true if the packet should be sent with the
+// compact header.
+func (c *Connection) useCompactHeader(p *Packet) bool {
+	return c.compactSession() && !isHandshakePacket(p)
+}
+
+// decodePacket builds a packet from the encoded bytes b, using the compact
+// header if one was agreed on for the session and b starts with one. Once it
+// has been, any other packet with a full header is left over from before.
+func (c *Connection) decodePacket(b []byte) (*Packet, error) {
+	if !c.compactSession() {
+		return DecodePacket(b, c.MaxPayloadSize)
+	}
+	if len(b) > 0 && b[0]&compactMarker != 0 {
+		p := acquirePacket()
+		err := c.compact.decode(p, b, c.MaxPayloadSize)
+		if err != nil {
+			ReleasePacket(p)
+			return nil, err
+		}
+		return p, nil
+	}
+	p, err := DecodePacket(b, c.MaxPayloadSize)
+	if err == nil && !isHandshakePacket(p) {
+		ReleasePacket(p)
+		return nil, fmt.Errorf("%w: only handshake packets have a full header once compact headers are agreed on.", ErrInvalidHeader)
+	}
+	return p, err
+}
+
+// sent records the sequence number and AckSeq of a packet that was sent.
+func (s *compactState) sent(seq, ackSeq uint32) {
+	if s.sentSeq != 0 && !seqGreaterThan(seq, s.sentSeq) {
+		return
+	}
+	s.sentSeq = seq
+	if ackSeq == 0 || (s.baseCount > 0 && ackSeq-s.bases[s.baseIndex].ackSeq < compactBaseStep) {
+		return
+	}
+	s.baseIndex = (s.baseIndex + 1) % len(s.bases)
+	s.bases[s.baseIndex] = compactBase{seq: seq, ackSeq: ackSeq}
+	if s.baseCount < len(s.bases) {
+		s.baseCount++
+	}
+}
+
+// base returns a sequence number no more than compactBaseStep behind the
+// AckSeq that the packet sent with seq carried, or false if it's too old.
+func (s *compactState) base(seq uint32) (uint32, bool) {
+	for i := 0; i < s.baseCount; i++ {
+		b := s.bases[(s.baseIndex-i+len(s.bases))%len(s.bases)]
+		if !seqGreaterThan(b.seq, seq) {
+			return b.ackSeq, true
+		}
+	}
+	return 0, false
+}
+
+// received records a packet read from the session's remote side.
+func (s *compactState) received(p *Packet) {
+	if s.recvSeq == 0 || seqGreaterThan(p.Seq, s.recvSeq) {
+		s.recvSeq = p.Seq
+		s.recvAck = p.AckSeq
+	}
+	if s.idPending && (&Packet{Seq: s.idSeq}).IsAckBy(p) {
+		s.idPending = false
+	}
+}
+
+// seqCode returns the size code for the fewest bytes of the packet's Seq the
+// remote side needs to expand it correctly. That's only known when the packet
+// acks the latest one read, since the remote side expands from the AckSeq
+// that one carried; otherwise the Seq is sent in full.
+func (s *compactState) seqCode(p *Packet) uint8 {
+	if p.AckSeq == 0 || p.AckSeq != s.recvSeq || s.recvAck == 0 {
+		return 2
+	}
+	switch d := p.Seq - s.recvAck; {
+	case d < 1<<6:
+		return 0
+	case d < 1<<14:
+		return 1
+	}
+	return 2
+}
+
+// append appends the packet with a compact header to b.
+func (s *compactState) append(b []byte, p *Packet) ([]byte, error) {
+	if p.PayloadSize > uint32(len(p.Payload)) {
+		return b, fmt.Errorf("Packet payload size %d is larger than its %d byte payload.", p.PayloadSize, len(p.Payload))
+	}
+
+	flags := compactMarker
+	if p.ClientId != s.sendId {
+		s.sendId = p.ClientId
+		s.idPending = true
+	}
+	if s.idPending {
+		flags |= compactClientId
+		s.idSeq = p.Seq
+	}
+	if p.Chan != 0 {
+		flags |= compactChan
+	}
+	if p.hasMsgId {
+		flags |= compactMsgId
+	}
+	seqCode := s.seqCode(p)
+	flags |= seqCode << compactSeqShift
+
+	ackMode := compactAckNone
+	mask := p.AckMask
+	if p.AckSeq != 0 || p.AckMask != 0 {
+		switch {
+		case mask == math.MaxUint32:
+			ackMode = compactAckAllOnes
+		case uvarintSize(^mask) < uvarintSize(mask):
+			ackMode = compactAckInverted
+			mask = ^mask
+		default:
+			ackMode = compactAckMask
+		}
+	}
+	flags |= ackMode
+
+	b = append(b, flags)
+	if flags&compactClientId != 0 {
+		b = binary.AppendUvarint(b, uint64(p.ClientId))
+	}
+	switch compactSeqSizes[seqCode] {
+	case 1:
+		b = append(b, uint8(p.Seq))
+	case 2:
+		b = byteOrder.AppendUint16(b, uint16(p.Seq))
+	default:
+		b = byteOrder.AppendUint32(b, p.Seq)
+	}
+	if flags&compactChan != 0 {
+		b = append(b, p.Chan)
+	}
+	if ackMode != compactAckNone {
+		b = byteOrder.AppendUint16(b, uint16(p.AckSeq))
+		if ackMode != compactAckAllOnes {
+			b = binary.AppendUvarint(b, uint64(mask))
+		}
+	}
+	if p.hasMsgId {
+		b = binary.AppendUvarint(b, uint64(p.MsgId))
+	}
+
+	return append(b, p.Payload[:p.PayloadSize]...), nil
+}
+
+// decode reads the packet with a compact header in b into p.
+func (s *compactState) decode(p *Packet, b []byte, maxPayloadSize int) error {
+	r := compactReader{b: b[1:]}
+	flags := b[0]
+
+	p.ClientId = s.recvId
+	if flags&compactClientId != 0 {
+		p.ClientId = r.uvarint32()
+	}
+
+	seqCode := (flags >> compactSeqShift) & compactSeqMask
+	if int(seqCode) >= len(compactSeqSizes) {
+		return fmt.Errorf("%w: unknown sequence size code %d.", ErrInvalidHeader, seqCode)
+	}
+	seqSize := compactSeqSizes[seqCode]
+	if seqSize == 4 {
+		p.Seq = r.uint32()
+	} else {
+		p.Seq = r.uintN(seqSize)
+	}
+
+	p.Chan = 0
+	if flags&compactChan != 0 {
+		p.Chan = r.byte()
+	}
+
+	p.AckSeq, p.AckMask = 0, 0
+	if ackMode := flags & compactAckBits; ackMode != compactAckNone {
+		ack := uint16(r.uintN(2))
+		p.AckSeq = s.sentSeq - uint32(uint16(s.sentSeq)-ack)
+		switch ackMode {
+		case compactAckAllOnes:
+			p.AckMask = math.MaxUint32
+		case compactAckMask:
+			p.AckMask = r.uvarint32()
+		case compactAckInverted:
+			p.AckMask = ^r.uvarint32()
+		}
+	}
+
+	p.MsgId, p.hasMsgId = 0, false
+	if flags&compactMsgId != 0 {
+		p.MsgId, p.hasMsgId = r.uvarint32(), true
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	if p.Chan&chanMsgIdFlag != 0 {
+		return fmt.Errorf("%w: channel %d is out of range.", ErrInvalidHeader, p.Chan)
+	}
+	if maxPayloadSize > 0 && len(r.b) > maxPayloadSize {
+		return fmt.Errorf("%w: %d bytes is over the maximum of %d.", ErrPayloadTooLarge, len(r.b), maxPayloadSize)
+	}
+	if seqSize < 4 {
+		base, ok := s.base(p.AckSeq)
+		if p.AckSeq == 0 || !ok {
+			return fmt.Errorf("%w: the sequence number can't be expanded.", ErrInvalidHeader)
+		}
+		p.Seq = base + (p.Seq-base)&(1<<(seqSize*8)-1)
+	}
+	if flags&compactClientId != 0 {
+		s.recvId = p.ClientId
+	}
+
+	p.PayloadSize = uint32(len(r.b))
+	p.Payload = append(p.Payload[:0], r.b...)
+	return nil
+}
+
+// uvarintSize returns how many bytes v takes as a uvarint.
+func uvarintSize(v uint32) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// compactReader reads the fields of a compact header, remembering the first
+// error so that it only needs checking at the end.
+type compactReader struct {
+	b   []byte
+	err error
+}
+
+func (r *compactReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = fmt.Errorf("%w: the compact header needs %d more bytes than the %d left.", ErrTruncatedHeader, n, len(r.b))
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *compactReader) byte() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *compactReader) uint32() uint32 {
+	if b := r.take(4); b != nil {
+		return byteOrder.Uint32(b)
+	}
+	return 0
+}
+
+// uintN reads an n byte unsigned integer, for n of 1 or 2.
+func (r *compactReader) uintN(n int) uint32 {
+	b := r.take(n)
+	if b == nil {
+		return 0
+	}
+	if n == 1 {
+		return uint32(b[0])
+	}
+	return uint32(byteOrder.Uint16(b))
+}
+
+func (r *compactReader) uvarint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 || v > math.MaxUint32 {
+		r.err = fmt.Errorf("%w: bad uvarint field.", ErrInvalidHeader)
+		return 0
+	}
+	r.b = r.b[n:]
+	return uint32(v)
+}
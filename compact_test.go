@@ -0,0 +1,350 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// compactPair connects a client and a listener over a MemoryNetwork with the
+// CompactHeaders settings supplied.
+func compactPair(t *testing.T, listenerCompact, clientCompact bool) (*Connection, *Connection) {
+	network := NewMemoryNetwork()
+	listenerConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	listener := NewTransportConnection(testServerBufferSize, listenerConn, nil)
+	listener.RequireHandshake = true
+	listener.CompactHeaders = listenerCompact
+	client := NewTransportConnection(testServerBufferSize, clientConn, listenerConn.LocalAddr())
+	client.CompactHeaders = clientCompact
+	for _, c := range []*Connection{listener, client} {
+		c.ReadTimeout = time.Millisecond
+		c.KeepAliveInterval = time.Millisecond * 10
+	}
+
+	if err = client.Connect(nil); err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	ok := tickUntil(listener, client, time.Second*2, func() bool {
+		return listener.State() == StateConnected && client.State() == StateConnected
+	})
+	if !ok {
+		t.Fatalf("Handshake did not complete (listener: %v, client: %v).", listener.State(), client.State())
+	}
+	return listener, client
+}
+
+func TestCompactHeaders(t *testing.T) {
+	tests := []struct {
+		listener, client bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("listener %v, client %v", test.listener, test.client)
+		listener, client := compactPair(t, test.listener, test.client)
+		compact := test.listener && test.client
+		if (listener.GetFeatures()&FeatureCompactHeaders != 0) != compact || (client.GetFeatures()&FeatureCompactHeaders != 0) != compact {
+			t.Errorf("%s: sides disagree on the compact header (listener: %v, client: %v).", name, listener.features, client.features)
+		}
+
+		var read []*Packet
+		listener.OnPacketRead = func(c *Connection, p *Packet) {
+			read = append(read, p)
+		}
+		client.SetChannelMode(1, ReliableOrdered)
+		const count = 50
+		for i := 0; i < count; i++ {
+			payload := []byte(fmt.Sprintf("%03d", i))
+			p := NewPacket(uint32(i/20), 0, uint8(i%2), 0, 0, uint32(len(payload)), payload)
+			if err := client.Send(p, true, nil); err != nil {
+				t.Fatalf("%s: client failed to send data.\n%v", name, err)
+			}
+			full := payloadOffset + len(payload)
+			if p.hasMsgId {
+				full += msgIdSize
+			}
+			if compact && len(client.frameBuffer) >= full {
+				t.Errorf("%s: packet %d took %d bytes, no less than the %d of the full header.", name, i, len(client.frameBuffer), full)
+			}
+			tickUntil(listener, client, time.Millisecond*50, func() bool {
+				return len(read) > i
+			})
+		}
+		tickUntil(listener, client, time.Second, func() bool {
+			return client.GetAcksNeededLen() == 0
+		})
+
+		if len(read) != count {
+			t.Fatalf("%s: listener read %d of %d packets.", name, len(read), count)
+		}
+		for i, p := range read {
+			if string(p.Payload[:p.PayloadSize]) != fmt.Sprintf("%03d", i) || p.ClientId != uint32(i/20) || p.Chan != uint8(i%2) {
+				t.Errorf("%s: packet %d was read as %+v.", name, i, p)
+			}
+		}
+		if client.GetAcksNeededLen() != 0 {
+			t.Errorf("%s: %d reliable packets were never acked.", name, client.GetAcksNeededLen())
+		}
+
+		listener.Close()
+		client.Close()
+	}
+}
+
+// TestCompactOldServer checks that a client offering the compact header
+// still connects to a server that ignores the offer.
+func TestCompactOldServer(t *testing.T) {
+	network := NewMemoryNetwork()
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	serverAddr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	client := NewTransportConnection(testServerBufferSize, clientConn, serverAddr)
+	defer client.Close()
+	client.CompactHeaders = true
+	if err = client.Connect(nil); err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+
+	// a challenge without the features after the cookie
+	challenge := append([]byte{ctrlChallenge}, make([]byte, cookieSize)...)
+	p := NewPacket(0, 1, ControlChannel, 0, 0, uint32(len(challenge)), challenge)
+	p.RemoteAddress = serverAddr
+	client.mu.Lock()
+	client.handleControl(p)
+	client.unlock()
+	if client.State() != StateChallenged {
+		t.Fatalf("Client should have accepted the challenge but is %v.", client.State())
+	}
+	if client.features != 0 || len(client.challenge) != cookieSize {
+		t.Errorf("Client agreed on features %v with a server that didn't offer any.", client.features)
+	}
+}
+
+// TestCompactDetection checks that full headers are only mistaken for
+// compact ones while a session has agreed on them, and that only handshake
+// packets may keep the full header then.
+func TestCompactDetection(t *testing.T) {
+	network := NewMemoryNetwork()
+	conn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	c := NewTransportConnection(testServerBufferSize, conn, nil)
+	defer c.Close()
+
+	// a data packet whose ClientId has the compact marker bit set
+	data := NewPacket(0x80000001, 7, 1, 0, 0, 4, []byte("PING"))
+	b, err := data.AppendBinary(nil)
+	if err != nil {
+		t.Fatalf("Failed to encode the packet.\n%v", err)
+	}
+	handshake := NewPacket(0, 8, ControlChannel, 0, 0, 2, []byte{ctrlReject, byte(RejectVersion)})
+	hb, err := handshake.AppendBinary(nil)
+	if err != nil {
+		t.Fatalf("Failed to encode the packet.\n%v", err)
+	}
+
+	// the features are left over from an earlier session
+	c.mu.Lock()
+	defer c.unlock()
+	c.features = FeatureCompactHeaders
+	p, err := c.decodePacket(b)
+	if err != nil {
+		t.Fatalf("Failed to decode a full header outside of a session.\n%v", err)
+	}
+	if p.ClientId != data.ClientId || p.Seq != data.Seq || string(p.Payload) != "PING" {
+		t.Errorf("The full header was read as %+v.", p)
+	}
+	ReleasePacket(p)
+
+	c.state = StateConnected
+	data.ClientId = 1
+	if b, err = data.AppendBinary(b[:0]); err != nil {
+		t.Fatalf("Failed to encode the packet.\n%v", err)
+	}
+	if _, err = c.decodePacket(b); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("A data packet with a full header should be rejected once compact headers are agreed on, got %v.", err)
+	}
+	p, err = c.decodePacket(hb)
+	if err != nil {
+		t.Fatalf("Failed to decode a handshake packet with a full header.\n%v", err)
+	}
+	if p.Seq != handshake.Seq || !isHandshakePacket(p) {
+		t.Errorf("The handshake packet was read as %+v.", p)
+	}
+	ReleasePacket(p)
+}
+
+// TestCompactSequences encodes a long run of packets between two compact
+// states, crossing the sequence wrap around, and checks every field
+// survives.
+func TestCompactSequences(t *testing.T) {
+	var sender, receiver compactState
+	seq := uint32(0xFFFFFF00)
+	remoteSeq := uint32(0xFFFFFFF0)
+	for i := 0; i < 1000; i++ {
+		// the receiver answers every few packets, acking the latest it read
+		if i%3 == 0 {
+			receiver.sent(remoteSeq, receiver.recvSeq)
+			sender.received(&Packet{Seq: remoteSeq, AckSeq: receiver.recvSeq, AckMask: 1})
+			remoteSeq++
+			if remoteSeq == 0 {
+				remoteSeq = 1
+			}
+		}
+
+		// the acks are sometimes for packets the receiver sent a little
+		// while ago, which have to carry the whole Seq
+		ackSeq := sender.recvSeq
+		if i%7 == 6 {
+			ackSeq -= 2
+		}
+		p := NewPacket(7, seq, uint8(i%3), ackSeq, 0xFFFF0FFF>>(i%32), 2, []byte{1, 2})
+		if i%5 == 0 {
+			p.MsgId, p.hasMsgId = uint32(i*1000), true
+		}
+		b, err := sender.append(nil, p)
+		if err != nil {
+			t.Fatalf("Failed to encode packet %d.\n%v", i, err)
+		}
+		sender.sent(p.Seq, p.AckSeq)
+
+		p2 := acquirePacket()
+		if err = receiver.decode(p2, b, 0); err != nil {
+			t.Fatalf("Failed to decode packet %d.\n%v", i, err)
+		}
+		if p2.ClientId != p.ClientId || p2.Seq != p.Seq || p2.Chan != p.Chan || p2.AckSeq != p.AckSeq || p2.AckMask != p.AckMask ||
+			p2.MsgId != p.MsgId || p2.hasMsgId != p.hasMsgId || string(p2.Payload) != string(p.Payload) {
+			t.Fatalf("Packet %d changed from %+v to %+v.", i, p, p2)
+		}
+		receiver.received(p2)
+		ReleasePacket(p2)
+
+		full := payloadOffset + len(p.Payload)
+		if p.hasMsgId {
+			full += msgIdSize
+		}
+		if i > 0 && len(b) >= full {
+			t.Errorf("Packet %d took %d bytes, no less than the %d of the full header.", i, len(b), full)
+		}
+		if i > 3 && i%7 != 6 && b[0]>>compactSeqShift&compactSeqMask != 0 {
+			t.Errorf("Packet %d should have been sent with a 1 byte Seq.", i)
+		}
+
+		seq++
+		if seq == 0 {
+			seq = 1
+		}
+	}
+	if sender.idPending {
+		t.Errorf("The ClientId should have stopped being sent once it was acked.")
+	}
+}
+
+// TestCompactReordered checks that a packet sent with a 1 byte Seq is still
+// read correctly after hundreds of later packets have overtaken it.
+func TestCompactReordered(t *testing.T) {
+	const late, count = 10, 400
+	var sender, receiver compactState
+	encoded := make([][]byte, count)
+	for i := 1; i < count; i++ {
+		// the receiver acks every packet it has read so far
+		receiver.sent(uint32(i), receiver.recvSeq)
+		sender.received(&Packet{Seq: uint32(i), AckSeq: receiver.recvSeq, AckMask: 1})
+
+		p := NewPacket(7, uint32(i), 1, sender.recvSeq, 1, 1, []byte{uint8(i)})
+		b, err := sender.append(nil, p)
+		if err != nil {
+			t.Fatalf("Failed to encode packet %d.\n%v", i, err)
+		}
+		sender.sent(p.Seq, p.AckSeq)
+		encoded[i] = b
+
+		// one packet is held back until all the others have arrived
+		if i == late {
+			continue
+		}
+		p2 := acquirePacket()
+		if err = receiver.decode(p2, b, 0); err != nil {
+			t.Fatalf("Failed to decode packet %d.\n%v", i, err)
+		}
+		if p2.Seq != uint32(i) {
+			t.Fatalf("Packet %d was read with Seq %d.", i, p2.Seq)
+		}
+		receiver.received(p2)
+		ReleasePacket(p2)
+	}
+
+	if size := compactSeqSizes[encoded[late][0]>>compactSeqShift&compactSeqMask]; size != 1 {
+		t.Fatalf("The late packet should have had a 1 byte Seq instead of %d.", size)
+	}
+	p := acquirePacket()
+	defer ReleasePacket(p)
+	if err := receiver.decode(p, encoded[late], 0); err != nil {
+		t.Fatalf("Failed to decode the late packet.\n%v", err)
+	}
+	if p.Seq != late {
+		t.Errorf("The packet %d packets late was read with Seq %d instead of %d.", count-late, p.Seq, late)
+	}
+}
+
+func TestCompactDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"missing seq", []byte{compactMarker | 2<<compactSeqShift, 1, 2}, ErrTruncatedHeader},
+		{"bad seq size", []byte{compactMarker | 3<<compactSeqShift, 1, 2, 3, 4}, ErrInvalidHeader},
+		{"bad client id", []byte{compactMarker | compactClientId, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, ErrInvalidHeader},
+		{"bad channel", []byte{compactMarker | compactChan, 1, 0x80}, ErrInvalidHeader},
+		{"over the maximum", []byte{compactMarker | 2<<compactSeqShift, 0, 0, 0, 1, 1, 2, 3, 4, 5}, ErrPayloadTooLarge},
+		{"unknown base", []byte{compactMarker | compactAckAllOnes, 1, 0, 9}, ErrInvalidHeader},
+	}
+	for _, test := range tests {
+		var s compactState
+		p := acquirePacket()
+		if err := s.decode(p, test.b, 4); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v but got %v.", test.name, test.err, err)
+		}
+		ReleasePacket(p)
+	}
+}
+
+// FuzzCompactDecode checks that no datagram makes the compact decoder panic.
+func FuzzCompactDecode(f *testing.F) {
+	var s compactState
+	p := NewPacket(42, 1000, 3, 900, 0xFFFF, 4, []byte("PING"))
+	b, _ := s.append(nil, p)
+	f.Add(b)
+	f.Add([]byte{compactMarker})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if len(b) == 0 {
+			return
+		}
+		s := compactState{sentSeq: 1000, recvSeq: 2000}
+		p := acquirePacket()
+		if err := s.decode(p, b, 0); err == nil && int(p.PayloadSize) != len(p.Payload) {
+			t.Fatalf("PayloadSize %d doesn't match the %d byte payload.", p.PayloadSize, len(p.Payload))
+		}
+		ReleasePacket(p)
+	})
+}
@@ -0,0 +1,132 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrentUse hammers a client and a server from several goroutines
+// at once; run it with -race to check the locking. It runs over a
+// MemoryNetwork so that every packet eventually gets through, however slowly
+// the goroutines get scheduled.
+func TestConcurrentUse(t *testing.T) {
+	network := NewMemoryNetwork()
+	serverConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	server, err := NewTransportServer(serverTestBufferSize, serverConn)
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.KeepAliveInterval = time.Millisecond * 10
+	server.SetChannelMode(1, ReliableUnordered)
+
+	var received int32
+	server.OnPacketRead = func(s *Server, peer *Connection, p *Packet) {
+		atomic.AddInt32(&received, 1)
+	}
+
+	client := NewTransportConnection(serverTestBufferSize, clientConn, serverConn.LocalAddr())
+	defer client.Close()
+	client.SetChannelMode(1, ReliableUnordered)
+	client.KeepAliveInterval = time.Millisecond * 10
+
+	var acked, failed int32
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// the server and client each get ticked on their own goroutine
+	loop := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					f()
+				}
+			}
+		}()
+	}
+	loop(func() { server.Tick() })
+	loop(func() { client.Tick() })
+
+	// while others poke at the state and the server talks back
+	loop(func() {
+		client.GetStats()
+		client.GetRTT()
+		client.GetAcksNeededLen()
+		client.GetLastSeenSeq()
+		server.GetStats()
+		time.Sleep(time.Millisecond)
+	})
+	loop(func() {
+		server.ForEachPeer(func(peer *Connection) bool {
+			pong := []byte("PONG")
+			peer.Send(NewPacket(0, 0, 0, 0, 0, uint32(len(pong)), pong), true, nil)
+			return true
+		})
+		time.Sleep(time.Millisecond * 5)
+	})
+
+	// and several goroutines send reliable packets at the same time
+	const senders = 4
+	const packetsPerSender = 50
+	var senderGroup sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		senderGroup.Add(1)
+		go func(i int) {
+			defer senderGroup.Done()
+			for j := 0; j < packetsPerSender; j++ {
+				payload := []byte(fmt.Sprintf("PING %d-%d", i, j))
+				rp := NewPacket(42, 0, 1, 0, 0, uint32(len(payload)), payload).MakeReliable(time.Millisecond*50, 255)
+				rp.OnAck = func(c *Connection, rp *ReliablePacket) {
+					atomic.AddInt32(&acked, 1)
+				}
+				rp.OnFailToAck = func(c *Connection, rp *ReliablePacket) {
+					atomic.AddInt32(&failed, 1)
+				}
+				if err := client.SendReliable(rp, true, nil); err != nil {
+					t.Errorf("Sender %d failed to send.\n%v", i, err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+	senderGroup.Wait()
+
+	// the deadline is only there to stop a hung test; on a MemoryNetwork
+	// nothing is lost, so everything gets acked long before it
+	const total = senders * packetsPerSender
+	endTime := time.Now().Add(time.Second * 30)
+	for time.Now().Before(endTime) && client.GetAcksNeededLen() > 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	close(done)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&received); got != total {
+		t.Errorf("Server should have read %d packets but read %d.", total, got)
+	}
+	if got := atomic.LoadInt32(&acked); got != total {
+		t.Errorf("Client should have had %d packets acked but had %d (%d failed).", total, got, atomic.LoadInt32(&failed))
+	}
+	if client.GetAcksNeededLen() != 0 {
+		t.Errorf("Client is still waiting on %d acks.", client.GetAcksNeededLen())
+	}
+}
@@ -4,10 +4,13 @@
 package netpeddler
 
 import (
-	"bytes"
 	"container/list"
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -16,12 +19,23 @@ type ConnectionReadEvent func(c *Connection, p *Packet)
 // Connection is the main structure for a network connection. It is designed around
 // a 1:1 relationship between client and server, but members can be tweaked to
 // more readily support 1:* relationship between server and clients.
-// NOTE: Per golang's net documentation, UDPConn can be accessed from multiple
-// threads safely.
+// NOTE: The methods of a Connection are safe to call from multiple goroutines.
+// Callbacks are fired after its lock is released, so they may call back into
+// the Connection, but the exported fields should be set before it's shared.
 type Connection struct {
-	Socket        *net.UDPConn
-	ListenAddress *net.UDPAddr
-	RemoteAddress *net.UDPAddr
+	Socket        net.PacketConn
+	ListenAddress net.Addr
+	RemoteAddress net.Addr
+
+	// ProtocolId, if not zero, is written before every packet sent and
+	// datagrams read that don't start with it are rejected with
+	// ErrProtocolMismatch. Both sides need to use the same value.
+	ProtocolId uint32
+
+	// UseChecksum indicates if a CRC32 is appended to every packet sent and
+	// checked on every datagram read; failures are rejected with
+	// ErrBadChecksum. Both sides need to use the same setting.
+	UseChecksum bool
 
 	// UpdateAcksOnRead indicates if Read() should update the lastAckMask and lastSeenSeq
 	// fields. When a connection is used to read from many clients this may turn out
@@ -29,33 +43,327 @@ type Connection struct {
 	UpdateAcksOnRead bool
 
 	// OnPacketRead is called from Tick() when a packet is successfully read
-	// in from the network connection.
+	// in from the network connection. When set, it also takes the place of
+	// the channel returned by Start().
 	OnPacketRead ConnectionReadEvent
 
+	// Filter, if set, is checked by Read() for every datagram before a packet
+	// is built from it; datagrams from addresses it refuses are dropped.
+	Filter AddressFilter
+
+	// RateLimit, if set, is checked by Read() for every datagram the Filter
+	// lets through; datagrams over the remote address's limit are dropped.
+	RateLimit *RateLimiter
+
+	// RequireHandshake indicates if the connection should only accept packets
+	// from a remote address that has completed the connection handshake. This is
+	// typically set on the listening side of a connection.
+	RequireHandshake bool
+
+	// OnConnectRequest is called when a remote address has answered the handshake
+	// challenge and decides whether or not it's accepted. If nil, all verified
+	// connection requests are accepted.
+	OnConnectRequest ConnectRequestEvent
+
+	// OnConnected is called when the handshake completes successfully.
+	OnConnected ConnectionEvent
+
+	// OnRejected is called when the remote side rejects the handshake or the
+	// handshake times out.
+	OnRejected RejectEvent
+
+	// KeepAliveInterval is how long the connection can go without sending
+	// anything before Tick() sends an empty packet to keep the remote side
+	// informed of acks. A zero value disables keepalives.
+	KeepAliveInterval time.Duration
+
+	// IdleTimeout is how long the connection can go without receiving
+	// anything before OnTimeout is fired and the session is ended the same
+	// way Disconnect() ends it.
+	// A zero value disables the timeout.
+	IdleTimeout time.Duration
+
+	// OnTimeout is called when IdleTimeout passes without a packet received.
+	OnTimeout ConnectionEvent
+
+	// OnDisconnected is called when the remote side ends the session with
+	// Disconnect().
+	OnDisconnected DisconnectEvent
+
+	// DropDuplicates indicates if Read() should drop packets whose MsgId was
+	// already read on the same channel, such as copies of a ReliablePacket
+	// that was resent before its ack arrived. Packets without a MsgId are
+	// never dropped as duplicates, and a MsgId further back than the window
+	// of remembered ones is taken as the remote side starting over.
+	DropDuplicates bool
+
+	// ReliableRetryInterval and ReliableRetryCount are used for packets sent
+	// with Send() on channels with a reliable DeliveryMode.
+	ReliableRetryInterval time.Duration
+	ReliableRetryCount    uint8
+
+	// AdaptiveRetry indicates if reliable packets should be resent based on
+	// the measured round-trip time instead of their RetryInterval, backing
+	// off exponentially with each attempt. RetryInterval is still used until
+	// the first round-trip time is measured.
+	AdaptiveRetry bool
+
+	// FragmentSize is the largest payload sent in a single datagram; larger
+	// packets are split into fragments of this size and put back together
+	// by Read() on the remote side. A zero value disables fragmentation.
+	FragmentSize int
+
+	// MaxFragments is the most fragments a single packet may be split into.
+	MaxFragments int
+
+	// MaxReassemblyBytes caps the memory used by fragments waiting on the
+	// rest of their packet; fragments that don't fit are dropped.
+	MaxReassemblyBytes int
+
+	// MaxFragmentGroups is the most packets that can be partially received
+	// at once; fragments of any more are dropped.
+	MaxFragmentGroups int
+
+	// FragmentTimeout is how long partially received packets are kept.
+	FragmentTimeout time.Duration
+
+	// OrderedGapTimeout is how long a ReliableOrdered channel holds packets
+	// waiting on a missing one, such as a packet the remote side gave up
+	// resending, before skipping past it. A zero value waits forever.
+	OrderedGapTimeout time.Duration
+
+	// ReliableFragments indicates if the fragments of packets sent with
+	// Send() should each be sent reliably. Fragments of packets sent with
+	// SendReliable() are always sent reliably.
+	ReliableFragments bool
+
+	// MinRetryTimeout and MaxRetryTimeout bound the retransmission timeout
+	// used with AdaptiveRetry.
+	MinRetryTimeout time.Duration
+	MaxRetryTimeout time.Duration
+
+	// HandshakeRetryInterval is how long to wait before resending a handshake
+	// packet that hasn't been answered.
+	HandshakeRetryInterval time.Duration
+
+	// HandshakeTimeout is how long Connect() will keep trying before giving up.
+	HandshakeTimeout time.Duration
+
+	// KeyExchange indicates if the handshake should agree on encryption keys
+	// for the session with X25519. Both sides need it set and the accepting
+	// side also needs RequireHandshake; the keys are put in place with
+	// SetEncryptionKeys() once the handshake is accepted. Handshake messages
+	// are sent in the clear and nothing else is read until the keys are set.
+	KeyExchange bool
+
+	// StaticKey is the long term X25519 key the accepting side of a handshake
+	// mixes into the key exchange so that clients can authenticate it.
+	StaticKey *ecdh.PrivateKey
+
+	// PinnedServerKey, if set, is the static public key the remote side has to
+	// prove it owns during the key exchange or the handshake is rejected.
+	PinnedServerKey *ecdh.PublicKey
+
+	// MinProtocolVersion is the oldest protocol version accepted from the
+	// remote side in a handshake; older remote sides are rejected with
+	// RejectVersion. A zero value accepts every version.
+	MinProtocolVersion uint8
+
+	// Features are the optional features, such as application defined ones
+	// from FeatureUser up, offered in the handshake along with the ones
+	// turned on by CompactHeaders and KeyExchange. GetFeatures() returns the
+	// ones both sides offered.
+	Features Feature
+
+	// CompactHeaders indicates if the handshake should offer the compact
+	// packet header, which drops the fields that aren't needed and shortens
+	// the rest. It's used for the session only if both sides offer it, so
+	// it's safe to set when talking to older versions; connections without
+	// a handshake always use the full header.
+	CompactHeaders bool
+
+	// UpdateInterval is how often a connection running in the background
+	// with Start() resends packets, sends keepalives and checks timeouts.
+	UpdateInterval time.Duration
+
+	// MaxPayloadSize, if not zero, is the largest payload accepted in a
+	// single datagram; larger packets are rejected with ErrPayloadTooLarge.
+	// Packets put back together from fragments are limited by
+	// MaxReassemblyBytes instead.
+	MaxPayloadSize int
+
+	// Clock, if set, is used in place of the real time for resending
+	// packets, timeouts and measuring the round-trip time.
+	Clock Clock
+
 	buffer       []byte
-	packetBuffer bytes.Buffer
+	encodeBuffer []byte
+	frameBuffer  []byte
+	sealBuffer   []byte
 	isOpen       bool
 	lastSeenSeq  uint32
 	lastAckMask  uint32
 	acksNeeded   *list.List
 	nextSeq      uint32
 	ReadTimeout  time.Duration
+
+	state          ConnectionState
+	connectData    []byte
+	challenge      []byte
+	cookieKey      []byte
+	handshakeStart time.Time
+	handshakeRetry time.Time
+
+	lastSendTime time.Time
+	lastRecvTime time.Time
+
+	channels map[uint8]*channel
+	pending  *list.List
+	stats    ConnectionStats
+
+	srtt   time.Duration
+	rttvar time.Duration
+	hasRTT bool
+
+	fragments         map[uint32]*fragmentGroup
+	fragmentsDone     dupeWindow
+	nextFragmentGroup uint32
+	reassemblyBytes   int
+
+	sendAEAD   cipher.AEAD
+	recvAEAD   cipher.AEAD
+	sendNonce  uint64
+	recvNonces replayWindow
+
+	// remoteLegacySeal is set if the last datagram opened was sealed the way
+	// protocol version 1 did
+	remoteLegacySeal bool
+
+	// the keys set with SetEncryptionKeys; sessions with a keySalt seal
+	// their packets with keys derived from them instead, but the handshake
+	// is still sealed with these
+	appSendKey  []byte
+	appRecvKey  []byte
+	appSendAEAD cipher.AEAD
+	appRecvAEAD cipher.AEAD
+	keySalt     []byte
+	clientSalt  []byte
+
+	kxKey       *ecdh.PrivateKey
+	acceptBody  []byte
+	sessionKeys bool
+
+	// version and features are what was agreed on in the handshake
+	version  uint8
+	features Feature
+	compact  compactState
+
+	server *Server
+	joined bool
+
+	// sharedSocket is set on clones, whose Socket belongs to the connection
+	// they were cloned from
+	sharedSocket bool
+
+	// stopBackground stops the goroutines started by Start()
+	stopBackground context.CancelFunc
+
+	// mu guards the connection's state and readMu guards the read buffer
+	// so that a blocking Read() doesn't hold up senders. Events raised
+	// while mu is held are queued and fired once it's released.
+	mu     sync.Mutex
+	readMu sync.Mutex
+	events []func()
+}
+
+// ConnectionStats holds counters kept by a Connection.
+type ConnectionStats struct {
+	// DuplicatesDropped is the number of packets dropped by Read() because
+	// their MsgId had already been read.
+	DuplicatesDropped uint64
+
+	// FragmentsDropped is the number of fragments thrown away because they
+	// were malformed, didn't fit in MaxReassemblyBytes or MaxFragmentGroups
+	// or timed out.
+	FragmentsDropped uint64
+
+	// ProtocolMismatches is the number of datagrams rejected because they
+	// didn't start with the ProtocolId.
+	ProtocolMismatches uint64
+
+	// BadChecksums is the number of datagrams rejected because their
+	// checksum didn't match.
+	BadChecksums uint64
+
+	// DecryptFailures is the number of datagrams rejected because they
+	// failed to decrypt.
+	DecryptFailures uint64
+
+	// ReplaysDropped is the number of encrypted datagrams dropped because
+	// they had already been read.
+	ReplaysDropped uint64
+
+	// FilteredDropped is the number of datagrams dropped because the
+	// Filter refused the address they came from.
+	FilteredDropped uint64
+
+	// RateLimited is the number of datagrams dropped for going over the
+	// RateLimit of the address they came from.
+	RateLimited uint64
+
+	// OrderedSkipped is the number of missing packets ReliableOrdered
+	// channels gave up waiting on, either after OrderedGapTimeout or to
+	// make room for packets further ahead.
+	OrderedSkipped uint64
+
+	// MalformedPackets is the number of datagrams rejected because they
+	// couldn't be decoded into a packet.
+	MalformedPackets uint64
+
+	// IncompatibleVersions is the number of handshakes rejected because
+	// there was no protocol version both sides accept.
+	IncompatibleVersions uint64
+
+	// AmplificationDropped is the number of replies to addresses that hadn't
+	// completed the handshake that weren't sent because they were bigger
+	// than the packet that prompted them.
+	AmplificationDropped uint64
 }
 
 const (
-	defaultBufferSize = 1500
+	defaultBufferSize             = 1500
+	defaultHandshakeRetryInterval = time.Millisecond * 250
+	defaultHandshakeTimeout       = time.Second * 5
+	defaultReliableRetryInterval  = time.Millisecond * 100
+	defaultReliableRetryCount     = 10
 )
 
 func New(bufferSize uint32) *Connection {
 	var newConn Connection
 	newConn.buffer = make([]byte, bufferSize)
 	newConn.UpdateAcksOnRead = true
+	newConn.DropDuplicates = true
 	newConn.isOpen = false
 	newConn.lastSeenSeq = 0
 	newConn.lastAckMask = 0
 	newConn.acksNeeded = list.New()
 	newConn.nextSeq = 1
 	newConn.OnPacketRead = nil
+	newConn.state = StateDisconnected
+	newConn.HandshakeRetryInterval = defaultHandshakeRetryInterval
+	newConn.HandshakeTimeout = defaultHandshakeTimeout
+	newConn.ReliableRetryInterval = defaultReliableRetryInterval
+	newConn.ReliableRetryCount = defaultReliableRetryCount
+	newConn.pending = list.New()
+	newConn.MinRetryTimeout = defaultMinRetryTimeout
+	newConn.MaxRetryTimeout = defaultMaxRetryTimeout
+	newConn.FragmentSize = defaultFragmentSize
+	newConn.MaxFragments = defaultMaxFragments
+	newConn.MaxReassemblyBytes = defaultMaxReassemblyBytes
+	newConn.MaxFragmentGroups = defaultMaxFragmentGroups
+	newConn.FragmentTimeout = defaultFragmentTimeout
+	newConn.OrderedGapTimeout = defaultOrderedGapTimeout
+	newConn.UpdateInterval = defaultUpdateInterval
 
 	// It appears that some platforms are sensitive to the value that's added here.
 	// For example, on Linux, 1 ns results in no packets being read, but 1 ms works.
@@ -70,8 +378,6 @@ func New(bufferSize uint32) *Connection {
 // local and remote addresses resolved. If no localAddress is specified, "127.0.0.1:0"
 // is used. RemoteAddress is only resolved and set if a remoteAddress was supplied.
 func NewConnection(bufferSize uint32, localAddress string, remoteAddress string) (*Connection, error) {
-	newConn := New(bufferSize)
-
 	// resolve the local address to use for listening
 	localAddressOpt := localAddress
 	if localAddressOpt == "" {
@@ -81,34 +387,29 @@ func NewConnection(bufferSize uint32, localAddress string, remoteAddress string)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to resolve the address to listen on: %s\n%v", localAddressOpt, err)
 	}
-	newConn.ListenAddress = addr
 
 	// if provided, resolve a remote address to use as a default for sending
+	var raddr net.Addr
 	if remoteAddress != "" {
-		raddr, err := net.ResolveUDPAddr("udp", remoteAddress)
+		udpAddr, err := net.ResolveUDPAddr("udp", remoteAddress)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to resolve the remote address: %s\n%v", remoteAddress, err)
 		}
-		newConn.RemoteAddress = raddr
+		raddr = udpAddr
 	}
 
-	// Go's net library still needs a UDPConn connection to access a lot of methods
-	// so we setup a listener for each connection.
-	conn, err := net.ListenUDP("udp", newConn.ListenAddress)
+	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to listen on the address: %s\n%v", localAddressOpt, err)
 	}
-
-	newConn.Socket = conn
 	if bufferSize > 0 {
 		// Setting the buffer size on the connection is important, but more important
 		// it seems in Linux, where you might blast through the buffer quickly.
 		conn.SetReadBuffer(int(bufferSize))
 		conn.SetWriteBuffer(int(bufferSize))
 	}
-	newConn.isOpen = true
 
-	return newConn, nil
+	return NewTransportConnection(bufferSize, conn, raddr), nil
 }
 
 // Clone makes a new Connection object but shares the same underlying Socket and
@@ -117,42 +418,99 @@ func NewConnection(bufferSize uint32, localAddress string, remoteAddress string)
 // many RemoteAddress's but wants to maintain separate ack and seq for each
 // remote address. By Cloning the Connection, the UDP packets will be sent
 // from the same port to the remote address which is critical for NAT punching.
-func (c *Connection) Clone(listenAddress *net.UDPAddr, remoteAddress *net.UDPAddr) *Connection {
+// Server manages a set of such connections automatically. A clone that times
+// out or is disconnected only ends its own session; the shared Socket stays
+// open until Close() is called.
+func (c *Connection) Clone(listenAddress net.Addr, remoteAddress net.Addr) *Connection {
+	c.readMu.Lock()
 	newConn := New(uint32(len(c.buffer)))
+	c.readMu.Unlock()
 	newConn.Socket = c.Socket
 	newConn.ListenAddress = listenAddress
 	newConn.RemoteAddress = remoteAddress
+	newConn.sharedSocket = true
+	c.mu.Lock()
+	newConn.isOpen = c.isOpen
+	c.mu.Unlock()
 	return newConn
 }
 
+// Close closes the connection's Socket. Peer connections owned by a Server
+// share its Socket, so closing one of them only removes it from the Server.
 func (c *Connection) Close() {
-	c.isOpen = false
+	if c.server != nil {
+		c.server.RemovePeer(c)
+		return
+	}
+	c.mu.Lock()
+	defer c.unlock()
+	c.close()
+}
+
+// close closes the Socket of a connection that isn't a Server peer.
+func (c *Connection) close() {
+	c.stop()
 	c.Socket.Close()
 }
 
+// stop marks the connection closed, fails the reliable packets still
+// waiting for an ack and stops its background goroutines without closing
+// the Socket.
+func (c *Connection) stop() {
+	if c.stopBackground != nil {
+		c.stopBackground()
+	}
+	c.isOpen = false
+	c.failReliable()
+}
+
 func (c *Connection) ResizeBuffer(bufferSize uint32) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
 	c.buffer = make([]byte, bufferSize)
 }
 
 func (c *Connection) IsOpen() bool {
+	c.mu.Lock()
+	defer c.unlock()
 	return c.isOpen
 }
 
 func (c *Connection) SetIsOpen(o bool) {
+	c.mu.Lock()
+	defer c.unlock()
 	c.isOpen = o
 }
 
+// GetStats returns a copy of the connection's counters.
+func (c *Connection) GetStats() ConnectionStats {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.stats
+}
+
 func (c *Connection) GetLastSeenSeq() uint32 {
+	c.mu.Lock()
+	defer c.unlock()
 	return c.lastSeenSeq
 }
 
 func (c *Connection) GetAckMask() uint32 {
+	c.mu.Lock()
+	defer c.unlock()
 	return c.lastAckMask
 }
 
 func (c *Connection) CalcAckMask(currentSeq uint32) (mask, seq uint32) {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.calcAckMask(currentSeq)
+}
+
+func (c *Connection) calcAckMask(currentSeq uint32) (mask, seq uint32) {
 	const maskDepth = 32
-	if c.lastSeenSeq < currentSeq { // New SEQ
+	// a last seen seq of 0 means nothing has been seen yet
+	if c.lastSeenSeq == 0 || seqGreaterThan(currentSeq, c.lastSeenSeq) { // New SEQ
 		// update the last seen data for new packets
 		seqDiff := currentSeq - c.lastSeenSeq
 		if seqDiff < maskDepth && seqDiff > 0 {
@@ -182,44 +540,179 @@ func (c *Connection) CalcAckMask(currentSeq uint32) (mask, seq uint32) {
 // Read attempts to read a UDP packet from the connection in a synchronous way.
 // If data was read, it constructs a new packet object, updates the ack masks
 // if desired and then returns it. The OnPacketRead event is fired if it's set.
+// Packets consumed by the library itself, such as handshake control packets,
+// are not returned; Read keeps waiting for the next packet instead.
+// Packets returned can be handed to ReleasePacket() once they're no longer
+// needed so that later reads can reuse them.
 func (c *Connection) Read() (*Packet, error) {
-	// read the raw data in from the UDP connection
-	n, addr, err := c.Socket.ReadFromUDP(c.buffer)
+	// packets released from an ordered channel are delivered first
+	c.mu.Lock()
+	p := c.popPending()
+	c.unlock()
+	if p != nil {
+		if c.OnPacketRead != nil {
+			c.OnPacketRead(c, p)
+		}
+		return p, nil
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		// read the raw data in from the UDP connection
+		n, addr, err := c.Socket.ReadFrom(c.buffer)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read bytes from UDP: %w\n", err)
+		}
+
+		p, deliver, err := c.readDatagram(c.buffer[:n], addr)
+		if err != nil {
+			return nil, err
+		}
+		if !deliver {
+			// the datagram may still have released packets held on an
+			// ordered channel, which go out before anything read later
+			c.mu.Lock()
+			p = c.popPending()
+			c.unlock()
+			if p == nil {
+				continue
+			}
+		}
+
+		// if the OnPacketRead event is defined, fire that
+		if c.OnPacketRead != nil {
+			c.OnPacketRead(c, p)
+		}
+
+		return p, nil
+	}
+}
+
+// readDatagram runs the datagram b read from addr through the Filter,
+// RateLimit and framing checks before handing it to handleDatagram.
+func (c *Connection) readDatagram(b []byte, addr net.Addr) (*Packet, bool, error) {
+	// the filter and rate limiter run without the lock so that they, and
+	// OnLimited, can call back into the connection
+	if c.Filter != nil && !c.Filter.Accept(addr) {
+		c.mu.Lock()
+		c.stats.FilteredDropped++
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+	if c.RateLimit != nil && !c.RateLimit.Allow(addr, len(b)) {
+		c.mu.Lock()
+		c.stats.RateLimited++
+		c.mu.Unlock()
+		return nil, false, nil
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+	b, err := unframeDatagram(b, c.ProtocolId, c.UseChecksum, &c.stats)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read packet from UDP: %w", err)
+	}
+	return c.handleDatagram(b, addr)
+}
+
+// handleDatagram turns the unframed bytes read from addr into a packet and runs
+// it through the connection's ack and control processing. The deliver flag is
+// false if the packet was consumed internally and should not be handed to
+// the application.
+func (c *Connection) handleDatagram(b []byte, addr net.Addr) (p *Packet, deliver bool, err error) {
+	// until a key exchange has set the keys only the handshake gets through
+	if c.KeyExchange && c.sendAEAD == nil {
+		c.handleClearHandshake(b, addr)
+		return nil, false, nil
+	}
+
+	// decrypt the packet if needed
+	plain, err := c.open(b)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read bytes from UDP: %v\n", err)
+		if c.handleClearHandshake(b, addr) {
+			return nil, false, nil
+		}
+		c.stats.DecryptFailures++
+		return nil, false, fmt.Errorf("Failed to read packet from UDP: %w", err)
 	}
+	if plain == nil {
+		return nil, false, nil
+	}
+	b = plain
 
 	// construct the packet
-	p, err := NewPacketFrom(n, c.buffer)
+	p, err = c.decodePacket(b)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to read packet from UDP: %v\n", err)
+		c.stats.MalformedPackets++
+		return nil, false, fmt.Errorf("Failed to read packet from UDP: %w", err)
 	}
 
 	// fill in the address the packet was received from
 	p.RemoteAddress = addr
 
+	// connections requiring a handshake only listen to their established peer;
+	// everything else is either part of a handshake or gets dropped
+	if c.RequireHandshake && !c.isSessionPacket(p) {
+		if p.Chan == ControlChannel {
+			c.handleControl(p)
+		}
+		ReleasePacket(p)
+		return nil, false, nil
+	}
+
+	c.lastRecvTime = c.now()
+	c.compact.received(p)
+
 	if c.UpdateAcksOnRead {
 		// calculate new ack masks and last seen seq numbers
-		//c.lastAckMask, c.lastSeenSeq = c.CalcAckMask(c.lastSeenSeq, p.Seq, c.lastAckMask)
-		c.CalcAckMask(p.Seq)
+		c.calcAckMask(p.Seq)
 
 		// update any packets that are awaiting their ACK
-		c.ProccessAcks(p)
+		c.processAcks(p)
+	}
+
+	if p.Chan == ControlChannel {
+		if p.PayloadSize == 0 || p.Payload[0] != ctrlFragment {
+			c.handleControl(p)
+			ReleasePacket(p)
+			return nil, false, nil
+		}
+
+		// fragments are delivered once the whole packet is back together;
+		// the pieces are copied out of the packets that carry them
+		fragment := p
+		p = c.receiveFragment(fragment)
+		ReleasePacket(fragment)
+		if p == nil {
+			return nil, false, nil
+		}
 	}
 
-	// if the OnPacketRead event is defined, fire that
-	if c.OnPacketRead != nil {
-		c.OnPacketRead(c, p)
+	c.checkRestart(p)
+	if c.isDuplicate(p) {
+		ReleasePacket(p)
+		return nil, false, nil
 	}
 
-	return p, nil
+	return p, c.receiveOnChannel(p), nil
 }
 
 // GetNextSeq returns a new sequence number for the connection and increments
-// the internal counter.
+// the internal counter. Sequence numbers wrap around, skipping 0 which is
+// reserved to mean that no sequence has been seen.
 func (c *Connection) GetNextSeq() uint32 {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.nextSequence()
+}
+
+func (c *Connection) nextSequence() uint32 {
 	seq := c.nextSeq
 	c.nextSeq++
+	if c.nextSeq == 0 {
+		c.nextSeq = 1
+	}
 	return seq
 }
 
@@ -227,32 +720,89 @@ func (c *Connection) GetNextSeq() uint32 {
 // If no remote address is supplied via parameter, it will use the connection's
 // remote address. If generateNewSeq is true, this method will set the packet's
 // sequence with a newly generated number from the connection.
-func (c *Connection) Send(p *Packet, generateNewSeq bool, remote *net.UDPAddr) error {
+// Packets sent on a channel with a reliable DeliveryMode are sent with
+// SendReliable() instead.
+func (c *Connection) Send(p *Packet, generateNewSeq bool, remote net.Addr) error {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.sendPacket(p, generateNewSeq, remote)
+}
+
+func (c *Connection) sendPacket(p *Packet, generateNewSeq bool, remote net.Addr) error {
+	if p.Chan > ControlChannel {
+		return fmt.Errorf("Packet channel %d is out of range.", p.Chan)
+	}
+
+	// packets on reliable channels get watched for acks like any other ReliablePacket
+	if c.channelMode(p.Chan).isReliable() {
+		rp := p.MakeReliable(c.ReliableRetryInterval, c.ReliableRetryCount)
+		return c.sendReliable(rp, generateNewSeq, remote)
+	}
+
+	c.assignMsgId(p, false)
+	if c.needsFragments(p) {
+		return c.sendFragments(p, nil, remote)
+	}
+	return c.send(p, generateNewSeq, remote)
+}
+
+// send encodes the packet with the connection's current ack data and writes
+// it to the socket; unlike Send it doesn't touch the packet's channel data,
+// so it's also used when resending reliable packets.
+func (c *Connection) send(p *Packet, generateNewSeq bool, remote net.Addr) error {
 	// generate a new seq number for the packet if requested
 	if generateNewSeq {
-		p.Seq = c.GetNextSeq()
+		p.Seq = c.nextSequence()
 	}
 
 	// update the ack data
-	p.AckSeq = c.GetLastSeenSeq()
-	p.AckMask = c.GetAckMask()
+	p.AckSeq = c.lastSeenSeq
+	p.AckMask = c.lastAckMask
 
 	// encode the packet to binary
-	p.WriteTo(&c.packetBuffer)
+	var encoded []byte
+	var err error
+	if c.useCompactHeader(p) {
+		encoded, err = c.compact.append(c.encodeBuffer[:0], p)
+	} else {
+		encoded, err = p.AppendBinary(c.encodeBuffer[:0])
+	}
+	if err != nil {
+		return err
+	}
+	c.encodeBuffer = encoded
+	c.compact.sent(p.Seq, p.AckSeq)
 
 	// use the remote address passed in to the function, but if one was not
 	// supplied, try to use the remote address setup in the connection.
 	sendAddr := remote
-	if sendAddr == nil {
+	if isNilAddr(sendAddr) {
 		sendAddr = c.RemoteAddress
-		if sendAddr == nil {
+		if isNilAddr(sendAddr) {
 			return fmt.Errorf("No remote address specified to send to.")
 		}
 	}
 
-	_, err := c.Socket.WriteToUDP(c.packetBuffer.Bytes(), sendAddr)
+	switch {
+	case c.KeyExchange && isHandshakePacket(p):
+		c.sealBuffer = append(c.sealBuffer[:0], encoded...)
+	case isHandshakePacket(p):
+		// the remote side may not have the session's keys yet
+		c.sealBuffer = c.seal(c.sealBuffer[:0], encoded, c.appSendAEAD, c.sealsLegacy(p))
+	default:
+		c.sealBuffer = c.seal(c.sealBuffer[:0], encoded, c.sendAEAD, c.sealsLegacy(p))
+	}
+	c.frameBuffer = frameDatagram(c.frameBuffer[:0], c.sealBuffer, c.ProtocolId, c.UseChecksum)
+	_, err = c.Socket.WriteTo(c.frameBuffer, sendAddr)
 	if err != nil {
-		return fmt.Errorf("Failed to send bytes on connection.\n%v", err)
+		return fmt.Errorf("Failed to send bytes on connection.\n%w", err)
+	}
+
+	// keep track of the time for keepalives; if nothing has been heard from
+	// the remote side yet, the idle timer starts with the first send
+	c.lastSendTime = c.now()
+	if c.lastRecvTime.IsZero() {
+		c.lastRecvTime = c.lastSendTime
 	}
 
 	return nil
@@ -263,17 +813,36 @@ func (c *Connection) Send(p *Packet, generateNewSeq bool, remote *net.UDPAddr) e
 // remote address. If generateNewSeq is true, this method will set the packet's
 // sequence with a newly generated number from the connection.
 // SendReliable also puts the packet in the list of packets awaiting acknowledgment.
-func (c *Connection) SendReliable(rp *ReliablePacket, generateNewSeq bool, remote *net.UDPAddr) error {
+func (c *Connection) SendReliable(rp *ReliablePacket, generateNewSeq bool, remote net.Addr) error {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.sendReliable(rp, generateNewSeq, remote)
+}
+
+func (c *Connection) sendReliable(rp *ReliablePacket, generateNewSeq bool, remote net.Addr) error {
+	if rp.Packet.Chan > ControlChannel {
+		return fmt.Errorf("Packet channel %d is out of range.", rp.Packet.Chan)
+	}
 	rp.Packet.RemoteAddress = remote
+	rp.done = make(chan struct{})
+	rp.acked = false
+
+	// large packets are sent as reliable fragments instead
+	c.assignMsgId(rp.Packet, true)
+	if c.needsFragments(rp.Packet) {
+		return c.sendFragments(rp.Packet, rp, remote)
+	}
 
 	// try to send the packet
-	err := c.Send(rp.Packet, generateNewSeq, remote)
+	err := c.send(rp.Packet, generateNewSeq, remote)
 	if err != nil {
 		return err
 	}
 
 	// update the next ack check time
-	rp.nextCheck = time.Now().Add(rp.RetryInterval)
+	rp.failCount = 0
+	rp.sentTime = c.now()
+	rp.nextCheck = rp.sentTime.Add(c.retryInterval(rp))
 
 	// add it to the list of packets to watch for acks
 	c.acksNeeded.PushBack(rp)
@@ -283,32 +852,58 @@ func (c *Connection) SendReliable(rp *ReliablePacket, generateNewSeq bool, remot
 
 // GetAcksNeededLen returns the number of ReliablePackets that need acknowledgment.
 func (c *Connection) GetAcksNeededLen() int {
+	c.mu.Lock()
+	defer c.unlock()
 	return c.acksNeeded.Len()
 }
 
 // Tick triest to read a packet -- if it finds one it will update the acks --
-// and then it tries to send out any reliable packets as necessary. Returns
-// a bool indicating if a packet was read and a possible error.
+// and then it tries to send out any reliable, handshake and keepalive packets
+// as necessary. Returns a bool indicating if a packet was read and a possible error.
 // NOTE: This primarily serves as a shortcut way of reading asynchronously.
 func (c *Connection) Tick() (bool, error) {
 	// listen for a packet
 	c.Socket.SetReadDeadline(time.Now().Add(c.ReadTimeout))
 	p, err := c.Read()
-	if err == nil && p != nil {
-		return true, err
+	gotPacket := err == nil && p != nil
+
+	c.mu.Lock()
+	defer c.unlock()
+	err = c.update()
+	return gotPacket, err
+}
+
+// update does the periodic work of the connection: resending handshake and
+// reliable packets, sending keepalives and checking for idle timeouts.
+func (c *Connection) update() error {
+	// resend any handshake packets that haven't been answered
+	err := c.updateHandshake()
+	if err != nil {
+		return err
 	}
+
 	// check for packets that need to be retried
-	err = c.RetryReliablePackets()
-	if p != nil {
-		return true, err
+	err = c.retryReliablePackets()
+	if err != nil {
+		return err
 	}
-	return false, err
+
+	c.expireFragments()
+	c.expireOrderedGaps()
+
+	return c.updateKeepAlive()
 }
 
 // ProccessAcks loops through acksNeeded checking to see if any ReliablePacket
 // is ack'd by the packet specified -- if so, the OnAck event is fired and
 // the ReliablePacket is removed from acksNeeded.
 func (c *Connection) ProccessAcks(p *Packet) {
+	c.mu.Lock()
+	defer c.unlock()
+	c.processAcks(p)
+}
+
+func (c *Connection) processAcks(p *Packet) {
 	e := c.acksNeeded.Front()
 	for e != nil {
 		nextElem := e.Next()
@@ -318,10 +913,10 @@ func (c *Connection) ProccessAcks(p *Packet) {
 		// check to see if the incoming packet acks the monitored reliable packet.
 		// if it does, remove it from the watch list and call the event
 		if rp.Packet.IsAckBy(p) {
+			// every resend uses a new seq, so the ack is for the latest send
+			c.updateRTT(c.now().Sub(rp.sentTime))
 			c.acksNeeded.Remove(e)
-			if rp.OnAck != nil {
-				rp.OnAck(c, rp)
-			}
+			c.fireAck(rp)
 		}
 
 		e = nextElem
@@ -332,6 +927,12 @@ func (c *Connection) ProccessAcks(p *Packet) {
 // a ReliablePacket if it's time. If the maximum number of tries was reached
 // then the packet is dropped from the acksNeeded.
 func (c *Connection) RetryReliablePackets() error {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.retryReliablePackets()
+}
+
+func (c *Connection) retryReliablePackets() error {
 	// loop through everything and retry if needed
 	e := c.acksNeeded.Front()
 	for e != nil {
@@ -359,27 +960,96 @@ func (c *Connection) RetryReliablePackets() error {
 // retryIfNeeded will retry a ReliablePacket if the time limit was hit on nextCheck.
 func (c *Connection) retryIfNeeded(rp *ReliablePacket) (resent bool, maxErrors bool, err error) {
 	// is it time for a resend?
-	t := time.Now()
+	t := c.now()
 	if t.Before(rp.nextCheck) {
 		return false, false, nil
 	}
 
 	// time for resend, so reset the timer and boost the fail count
-	rp.nextCheck = rp.nextCheck.Add(rp.RetryInterval)
 	rp.failCount++
+	if c.AdaptiveRetry {
+		rp.nextCheck = t.Add(c.retryInterval(rp))
+	} else {
+		rp.nextCheck = rp.nextCheck.Add(rp.RetryInterval)
+	}
 
 	// if we have more retrys left, give it another shot
 	if rp.failCount <= rp.RetryCount {
 		resent = true
-		err = c.Send(rp.Packet, true, rp.Packet.RemoteAddress)
+		rp.sentTime = t
+		err = c.send(rp.Packet, true, rp.Packet.RemoteAddress)
 		return true, false, err
 	}
 
 	// if we go here, it was time for a resend but we reached max fails,
 	// so call the event for this
+	c.fireFailToAck(rp)
+
+	return false, true, nil
+}
+
+// unlock releases mu and then fires the events queued while it was held,
+// so that event handlers are free to call back into the connection.
+func (c *Connection) unlock() {
+	events := c.events
+	c.events = nil
+	c.mu.Unlock()
+
+	for _, f := range events {
+		f()
+	}
+}
+
+// queueEvent queues f to be called once mu is released.
+func (c *Connection) queueEvent(f func()) {
+	c.events = append(c.events, f)
+}
+
+// fireAck queues the OnAck event of the reliable packet. Fragments of a
+// larger packet are counted right away instead.
+func (c *Connection) fireAck(rp *ReliablePacket) {
+	if rp.fragments != nil {
+		rp.fragments.onAck(c)
+		return
+	}
+	rp.finish(true)
+	if rp.OnAck != nil {
+		c.queueEvent(func() { rp.OnAck(c, rp) })
+	}
+}
+
+// fireFailToAck queues the OnFailToAck event of the reliable packet.
+func (c *Connection) fireFailToAck(rp *ReliablePacket) {
+	if rp.fragments != nil {
+		rp.fragments.onFailToAck(c)
+		return
+	}
+	rp.finish(false)
 	if rp.OnFailToAck != nil {
-		rp.OnFailToAck(c, rp)
+		c.queueEvent(func() { rp.OnFailToAck(c, rp) })
 	}
+}
 
-	return false, true, nil
+// failReliable fires OnFailToAck for every reliable packet still waiting for
+// an ack and forgets them, since they'll never be acked once the session is
+// over.
+func (c *Connection) failReliable() {
+	for e := c.acksNeeded.Front(); e != nil; e = e.Next() {
+		c.fireFailToAck(e.Value.(*ReliablePacket))
+	}
+	c.acksNeeded.Init()
+}
+
+// finish records whether the reliable packet was acked and wakes up
+// anything in WaitForAck().
+func (rp *ReliablePacket) finish(acked bool) {
+	if rp.done == nil {
+		return
+	}
+	select {
+	case <-rp.done:
+	default:
+		rp.acked = acked
+		close(rp.done)
+	}
 }
@@ -0,0 +1,133 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	// ErrNotAcked is returned by WaitForAck() when a ReliablePacket ran out
+	// of retries without being acknowledged.
+	ErrNotAcked = errors.New("The reliable packet was never acknowledged.")
+)
+
+// ReadContext works like Read() but gives up when the context is cancelled
+// or its deadline passes, returning the context's error. The deadline is set
+// on the Socket while the read is waiting, so only one read should wait at
+// a time.
+func (c *Connection) ReadContext(ctx context.Context) (*Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, c.Socket.SetReadDeadline)
+	p, err := c.Read()
+	stop()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	return p, nil
+}
+
+// SendContext works like Send() but returns the context's error instead of
+// sending if the context is done, and won't block on the Socket past the
+// context's deadline.
+func (c *Connection) SendContext(ctx context.Context, p *Packet, generateNewSeq bool, remote net.Addr) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stop := watchContext(ctx, c.Socket.SetWriteDeadline)
+	err := c.Send(p, generateNewSeq, remote)
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return nil
+}
+
+// WaitForAck blocks until the ReliablePacket sent with SendReliable() is
+// acknowledged, returning nil, or runs out of retries or has its session
+// end, returning ErrNotAcked. Acks are only read by Read() or Tick(), so the connection
+// needs to be running in the background with Start() or be polled from
+// another goroutine while waiting. If the context is done first, its error
+// is returned.
+func (c *Connection) WaitForAck(ctx context.Context, rp *ReliablePacket) error {
+	c.mu.Lock()
+	done := rp.done
+	c.unlock()
+	if done == nil {
+		return fmt.Errorf("The packet hasn't been sent with SendReliable().")
+	}
+
+	select {
+	case <-done:
+		c.mu.Lock()
+		defer c.unlock()
+		if !rp.acked {
+			return ErrNotAcked
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReadContext works like Read() but gives up when the context is cancelled
+// or its deadline passes, the same way Connection.ReadContext() does.
+func (s *Server) ReadContext(ctx context.Context) (*Connection, *Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	stop := watchContext(ctx, s.Socket.SetReadDeadline)
+	peer, p, err := s.Read()
+	stop()
+	if err != nil {
+		return peer, nil, contextError(ctx, err)
+	}
+	return peer, p, nil
+}
+
+// watchContext sets a Socket deadline with setDeadline to the context's
+// deadline, and to now if the context is cancelled, to wake up a blocked
+// read or write. The function returned stops watching the context and
+// clears the deadline.
+func watchContext(ctx context.Context, setDeadline func(time.Time) error) (stop func()) {
+	deadline, _ := ctx.Deadline()
+	setDeadline(deadline)
+
+	finished := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+
+	return func() {
+		close(finished)
+		<-stopped
+		setDeadline(time.Time{})
+	}
+}
+
+// contextError returns the context's error for a read or write that failed
+// because of the deadline watchContext() set.
+func contextError(ctx context.Context, err error) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	// the Socket can beat the context's own timer to the deadline
+	return context.DeadlineExceeded
+}
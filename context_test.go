@@ -0,0 +1,169 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	contextTestPort = 42090
+)
+
+func TestReadContext(t *testing.T) {
+	listener, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", contextTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the listener.\n%v", err)
+	}
+	defer listener.Close()
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", contextTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+
+	// nothing has been sent, so the read should time out
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	_, err = listener.ReadContext(ctx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Read should have hit the deadline but returned: %v", err)
+	}
+
+	// or get cancelled from another goroutine
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		cancel()
+	}()
+	_, err = listener.ReadContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Read should have been cancelled but returned: %v", err)
+	}
+
+	// sending with a cancelled context doesn't send anything
+	testPayload := []byte("PING")
+	err = client.SendContext(ctx, NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Send should have been cancelled but returned: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = client.SendContext(ctx, NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+
+	p, err := listener.ReadContext(ctx)
+	if err != nil {
+		t.Fatalf("Listener failed to read data.\n%v", err)
+	}
+	if p.Seq != 1 {
+		t.Errorf("The cancelled send shouldn't have used a sequence; got seq %d.", p.Seq)
+	}
+}
+
+func TestWaitForAck(t *testing.T) {
+	server, err := NewServer(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", contextTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.KeepAliveInterval = time.Millisecond * 20
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", contextTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if _, err := server.Start(ctx); err != nil {
+		t.Fatalf("Failed to start the server.\n%v", err)
+	}
+	if _, err := client.Start(ctx); err != nil {
+		t.Fatalf("Failed to start the client.\n%v", err)
+	}
+
+	testPayload := []byte("PING")
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Millisecond*100, 5)
+	if err := client.WaitForAck(ctx, rp); err == nil {
+		t.Errorf("Waiting on a packet that wasn't sent should fail.")
+	}
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	if err := client.WaitForAck(ctx, rp); err != nil {
+		t.Errorf("Packet should have been acked.\n%v", err)
+	}
+
+	// nothing listens on this port, so the packet runs out of retries
+	unacked := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Millisecond*20, 2)
+	nowhere := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: contextTestPort + 2}
+	err = client.SendReliable(unacked, true, nowhere)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	shortCtx, shortCancel := context.WithTimeout(ctx, time.Millisecond*10)
+	err = client.WaitForAck(shortCtx, unacked)
+	shortCancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait should have hit the deadline but returned: %v", err)
+	}
+	if err := client.WaitForAck(ctx, unacked); err != ErrNotAcked {
+		t.Errorf("Packet should have failed to be acked but returned: %v", err)
+	}
+}
+
+// TestWaitForAckSessionEnd makes sure WaitForAck returns once the session
+// the packet was sent on ends, rather than waiting on an ack that can't come.
+func TestWaitForAckSessionEnd(t *testing.T) {
+	network := NewMemoryNetwork()
+	nowhere := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	testPayload := []byte("PING")
+
+	ends := []struct {
+		name string
+		end  func(c *Connection)
+	}{
+		{"disconnect", func(c *Connection) { c.Disconnect(DisconnectShutdown) }},
+		{"close", func(c *Connection) { c.Close() }},
+	}
+	for _, end := range ends {
+		clientConn, err := network.Listen("")
+		if err != nil {
+			t.Fatalf("Failed to listen on the memory network.\n%v", err)
+		}
+		client := NewTransportConnection(testServerBufferSize, clientConn, nowhere)
+		rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Minute, 5)
+		failed := false
+		rp.OnFailToAck = func(c *Connection, rp *ReliablePacket) {
+			failed = true
+		}
+		if err = client.SendReliable(rp, true, nil); err != nil {
+			t.Fatalf("%s: client failed to send data.\n%v", end.name, err)
+		}
+		end.end(client)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = client.WaitForAck(ctx, rp)
+		cancel()
+		if err != ErrNotAcked || !failed {
+			t.Errorf("%s: packet should have failed (failed: %v) but the wait returned: %v", end.name, failed, err)
+		}
+		if client.GetAcksNeededLen() != 0 {
+			t.Errorf("%s: client is still waiting on %d acks.", end.name, client.GetAcksNeededLen())
+		}
+		client.Close()
+	}
+}
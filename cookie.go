@@ -0,0 +1,129 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"time"
+)
+
+// The handshake challenge is a stateless cookie: a timestamp followed by an
+// HMAC of the remote address and the timestamp. The accepting side keeps
+// nothing for an address until it echoes back a cookie made for it, which
+// proves it can receive packets at that address. Any bytes sent after the
+// cookie, such as the version agreed on, are covered by the HMAC as well.
+const (
+	cookieTimeSize = 8
+	cookieMACSize  = 16
+	cookieSize     = cookieTimeSize + cookieMACSize
+
+	cookieKeySize = 32
+)
+
+// makeCookie creates the cookie sent to the remote address in a challenge,
+// followed by ext.
+func (c *Connection) makeCookie(remote net.Addr, ext []byte) ([]byte, error) {
+	// the secret key is made the first time it's needed
+	if c.cookieKey == nil {
+		key := make([]byte, cookieKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		c.cookieKey = key
+	}
+
+	cookie := make([]byte, cookieTimeSize, cookieSize+len(ext))
+	byteOrder.PutUint64(cookie, uint64(c.now().UnixNano()))
+	cookie = append(cookie, c.cookieMAC(remote, cookie, ext)...)
+	return append(cookie, ext...), nil
+}
+
+// checkCookie returns true if the cookie was made for the remote address
+// and ext by this side and hasn't outlived HandshakeTimeout.
+func (c *Connection) checkCookie(cookie []byte, remote net.Addr, ext []byte) bool {
+	if c.cookieKey == nil || len(cookie) != cookieSize {
+		return false
+	}
+	if !hmac.Equal(cookie[cookieTimeSize:], c.cookieMAC(remote, cookie[:cookieTimeSize], ext)) {
+		return false
+	}
+
+	age := c.now().Sub(time.Unix(0, int64(byteOrder.Uint64(cookie))))
+	return age >= 0 && age <= c.HandshakeTimeout
+}
+
+// openCookie checks the cookie at the start of a challenge response body
+// from the remote address. Older clients echo just the cookie; newer ones
+// echo the version and features agreed on that followed it too. Returns
+// those, or nil for an older client, and the rest of the body.
+func (c *Connection) openCookie(body []byte, remote net.Addr) (ext []byte, rest []byte, ok bool) {
+	if len(body) < cookieSize {
+		return nil, nil, false
+	}
+	if c.checkCookie(body[:cookieSize], remote, nil) {
+		return nil, body[cookieSize:], true
+	}
+	end := cookieSize + agreementSize
+	if len(body) >= end && c.checkCookie(body[:cookieSize], remote, body[cookieSize:end]) {
+		return body[cookieSize:end], body[end:], true
+	}
+	return nil, nil, false
+}
+
+// cookieMAC returns the HMAC of the remote address, the cookie's time and
+// ext.
+func (c *Connection) cookieMAC(remote net.Addr, cookieTime []byte, ext []byte) []byte {
+	mac := hmac.New(sha256.New, c.cookieKey)
+	mac.Write([]byte(remote.String()))
+	mac.Write(cookieTime)
+	mac.Write(ext)
+	return mac.Sum(nil)[:cookieMACSize]
+}
+
+// readUnverified builds a packet from a datagram sent by an address that
+// has no session. Nothing is recorded about the address, not even the nonce
+// used for the replay check, so nil is returned for anything that fails.
+func (c *Connection) readUnverified(b []byte, addr net.Addr) *Packet {
+	if c.appRecvAEAD != nil && !c.KeyExchange {
+		plain, err := decrypt(c.appRecvAEAD, b)
+		if err != nil {
+			c.stats.DecryptFailures++
+			return nil
+		}
+		c.remoteLegacySeal = sealedLegacy(b)
+		b = plain
+	}
+	p, err := DecodePacket(b, c.MaxPayloadSize)
+	if err != nil {
+		c.stats.MalformedPackets++
+		return nil
+	}
+	p.RemoteAddress = addr
+	return p
+}
+
+// isCookieResponse returns true if the packet is a challenge response that
+// echoes a valid cookie for the address it came from.
+func (c *Connection) isCookieResponse(p *Packet) bool {
+	if p.Chan != ControlChannel || p.PayloadSize < 1+cookieSize || p.Payload[0] != ctrlChallengeResponse {
+		return false
+	}
+	_, _, ok := c.openCookie(p.Payload[1:p.PayloadSize], p.RemoteAddress)
+	return ok
+}
+
+// sendUnverified sends a control message to an address that hasn't proven
+// it owns it yet. To keep from being used to amplify a flood at someone
+// else's address, the message is only sent if its payload is no bigger than
+// the payload received from the address.
+func (c *Connection) sendUnverified(t uint8, body []byte, remote net.Addr, received int) error {
+	if 1+len(body) > received {
+		c.stats.AmplificationDropped++
+		return nil
+	}
+	return c.sendControl(t, body, remote)
+}
@@ -0,0 +1,138 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	cookieTestPort = 42075
+)
+
+func TestCookies(t *testing.T) {
+	c := New(0)
+	a := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1001}
+
+	cookie, err := c.makeCookie(a, nil)
+	if err != nil {
+		t.Fatalf("Failed to make a cookie.\n%v", err)
+	}
+	if !c.checkCookie(cookie, a, nil) {
+		t.Errorf("A fresh cookie should check out.")
+	}
+	if c.checkCookie(cookie, b, nil) {
+		t.Errorf("A cookie should only check out for the address it was made for.")
+	}
+
+	forged := append([]byte(nil), cookie...)
+	forged[cookieSize-1] ^= 0x01
+	if c.checkCookie(forged, a, nil) {
+		t.Errorf("A tampered cookie checked out.")
+	}
+	if New(0).checkCookie(cookie, a, nil) {
+		t.Errorf("A cookie checked out with a different key.")
+	}
+
+	c.HandshakeTimeout = time.Millisecond * 10
+	time.Sleep(time.Millisecond * 20)
+	if c.checkCookie(cookie, a, nil) {
+		t.Errorf("An expired cookie checked out.")
+	}
+}
+
+func TestServerStatelessHandshake(t *testing.T) {
+	server, err := NewServer(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", cookieTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", cookieTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+
+	// answering the connect request keeps no state for the client
+	client.Connect(nil)
+	endTime := time.Now().Add(time.Second)
+	for time.Now().Before(endTime) && client.State() != StateChallenged {
+		server.Tick()
+		client.Tick()
+	}
+	if client.State() != StateChallenged {
+		t.Fatalf("Client never got a challenge (%v).", client.State())
+	}
+	if len(server.peers) != 0 {
+		t.Errorf("Server made a peer before the client echoed its cookie.")
+	}
+
+	// a made up cookie doesn't get a peer either
+	forger, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", cookieTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the forging client.\n%v", err)
+	}
+	defer forger.Close()
+	forger.sendControl(ctrlChallengeResponse, make([]byte, cookieSize+1), nil)
+	for i := 0; i < 10; i++ {
+		server.Tick()
+	}
+	if server.peers[forger.Socket.LocalAddr().String()] != nil {
+		t.Errorf("Server made a peer for a forged cookie.")
+	}
+
+	// the client's real cookie completes the handshake
+	endTime = time.Now().Add(time.Second * 2)
+	for time.Now().Before(endTime) && client.State() != StateConnected {
+		server.Tick()
+		client.Tick()
+	}
+	if client.State() != StateConnected || server.GetPeerCount() != 1 {
+		t.Fatalf("Handshake did not complete (%v, %d peers).", client.State(), server.GetPeerCount())
+	}
+}
+
+func TestAmplificationBudget(t *testing.T) {
+	server, err := NewServer(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", cookieTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", cookieTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+	client.state = StateConnecting
+
+	// a connect request smaller than the challenge goes unanswered
+	client.sendControl(ctrlConnectRequest, nil, nil)
+	server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	server.Read()
+	if server.GetStats().AmplificationDropped != 1 {
+		t.Errorf("Server should have withheld one reply but withheld %d.", server.GetStats().AmplificationDropped)
+	}
+	client.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if _, err := client.Read(); err == nil {
+		t.Errorf("Server answered a connect request with more than it received.")
+	}
+
+	// while a padded one gets its challenge
+	client.sendControl(ctrlConnectRequest, make([]byte, cookieSize), nil)
+	server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	server.Read()
+	client.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	client.Read()
+	if client.State() != StateChallenged {
+		t.Errorf("Client didn't get a challenge for a padded request (%v).", client.State())
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrDecryptFailed is returned when an encrypted datagram can't be
+	// opened, which means it was tampered with, corrupted or sealed with
+	// a different key.
+	ErrDecryptFailed = errors.New("Datagram failed to decrypt.")
+)
+
+const (
+	// every encrypted datagram starts with a counter, used to drop replays,
+	// followed by the random nonce it was sealed with. Protocol version 1
+	// used the counter as the nonce instead; its datagrams are told apart by
+	// the high bit of the counter, which is only set with a random nonce.
+	nonceCounterSize = 8
+	nonceSize        = 12
+	sealRandomNonce  = uint64(1) << 63
+
+	// the size of the random salt the connecting side adds to the challenge
+	// cookie to make the keys for a session
+	clientSaltSize = 8
+
+	// the label used as the HKDF info when deriving a session's keys from
+	// the application's keys
+	keySaltLabel = "netpeddler packet keys v1"
+)
+
+// SetEncryptionKeys turns on encryption for the connection. Every packet sent
+// is sealed with AES-GCM using sendKey and every datagram read has to open
+// with recvKey or it's rejected with ErrDecryptFailed. The keys must be 16,
+// 24 or 32 bytes long and the remote side has to use the same keys the other
+// way around; each direction needs its own key so that packets can't be
+// reflected back at the side that sent them. Packets are sealed with random
+// nonces, so the same keys can be shared by any number of connections.
+// Sessions that complete the handshake on protocol version 2 or newer seal
+// their packets with keys derived from these and a salt both sides add to,
+// so that packets from one session can't be replayed into another. Sessions
+// on version 1 seal packets the way that version did, with the counter as the
+// nonce; connections without a handshake always use the newer format.
+func (c *Connection) SetEncryptionKeys(sendKey, recvKey []byte) error {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.setEncryptionKeys(sendKey, recvKey)
+}
+
+func (c *Connection) setEncryptionKeys(sendKey, recvKey []byte) error {
+	sendAEAD, err := newAEAD(sendKey)
+	if err != nil {
+		return fmt.Errorf("Failed to set up the send key.\n%v", err)
+	}
+	recvAEAD, err := newAEAD(recvKey)
+	if err != nil {
+		return fmt.Errorf("Failed to set up the receive key.\n%v", err)
+	}
+
+	c.appSendKey = append([]byte(nil), sendKey...)
+	c.appRecvKey = append([]byte(nil), recvKey...)
+	c.appSendAEAD = sendAEAD
+	c.appRecvAEAD = recvAEAD
+	c.sessionKeys = false
+	return c.useAppKeys()
+}
+
+// ClearEncryptionKeys turns off encryption for the connection.
+func (c *Connection) ClearEncryptionKeys() {
+	c.mu.Lock()
+	defer c.unlock()
+	c.appSendKey = nil
+	c.appRecvKey = nil
+	c.appSendAEAD = nil
+	c.appRecvAEAD = nil
+	c.sessionKeys = false
+	c.useAEADs(nil, nil)
+}
+
+// IsEncrypted returns true if the connection has encryption keys set.
+func (c *Connection) IsEncrypted() bool {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.sendAEAD != nil
+}
+
+// setKeySalt records the salt for the session's keys and, if the application
+// set keys, derives the session's keys from them.
+func (c *Connection) setKeySalt(salt []byte) error {
+	c.keySalt = salt
+	if c.sessionKeys || c.appSendKey == nil {
+		return nil
+	}
+	return c.useAppKeys()
+}
+
+// useAppKeys puts the application's keys in place, or the keys derived from
+// them if the session has a key salt.
+func (c *Connection) useAppKeys() error {
+	if c.keySalt == nil {
+		c.useAEADs(c.appSendAEAD, c.appRecvAEAD)
+		return nil
+	}
+	return c.useKeys(deriveKey(c.appSendKey, c.keySalt), deriveKey(c.appRecvKey, c.keySalt))
+}
+
+// useKeys seals and opens packets with the keys supplied from now on.
+func (c *Connection) useKeys(sendKey, recvKey []byte) error {
+	sendAEAD, err := newAEAD(sendKey)
+	if err != nil {
+		return fmt.Errorf("Failed to set up the send key.\n%v", err)
+	}
+	recvAEAD, err := newAEAD(recvKey)
+	if err != nil {
+		return fmt.Errorf("Failed to set up the receive key.\n%v", err)
+	}
+	c.useAEADs(sendAEAD, recvAEAD)
+	return nil
+}
+
+// useAEADs swaps in the ciphers supplied. The counters seen under the old
+// receive key mean nothing under the new one, so they're forgotten; the send
+// counter keeps going.
+func (c *Connection) useAEADs(sendAEAD, recvAEAD cipher.AEAD) {
+	c.sendAEAD = sendAEAD
+	c.recvAEAD = recvAEAD
+	c.recvNonces = replayWindow{}
+}
+
+// sealsLegacy returns true if the packet has to be sealed the way protocol
+// version 1 did. Handshake packets are sealed the way the remote side sealed
+// its last one, since the version may not be agreed on yet.
+func (c *Connection) sealsLegacy(p *Packet) bool {
+	if isHandshakePacket(p) {
+		return c.remoteLegacySeal
+	}
+	return c.version != 0 && c.version < randomNonceVersion
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey runs HKDF with SHA-256 over the key and salt to get a key of the
+// same size for one session.
+func deriveKey(key, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	prk := extract.Sum(nil)
+
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(keySaltLabel))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:len(key)]
+}
+
+// makeNonce builds the fixed AES-GCM nonce for the counter, which is only
+// used for the key exchange's confirmation tag.
+func makeNonce(aead cipher.AEAD, counter []byte) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce[len(nonce)-nonceCounterSize:], counter)
+	return nonce
+}
+
+// seal encrypts the encoded packet b with aead if it's set, appending the
+// counter and the random nonce followed by the ciphertext to dst. The counter
+// is authenticated along with the packet. The legacy format leaves out the
+// random nonce and uses the counter in its place.
+func (c *Connection) seal(dst []byte, b []byte, aead cipher.AEAD, legacy bool) []byte {
+	if aead == nil {
+		return append(dst, b...)
+	}
+
+	// the counter starts from the real time rather than the Clock so that a
+	// restarted process carries on past the counters it used before
+	if c.sendNonce == 0 {
+		c.sendNonce = uint64(time.Now().UnixNano())
+	}
+	counter := c.sendNonce
+	c.sendNonce++
+
+	var header [nonceCounterSize + nonceSize]byte
+	if legacy {
+		byteOrder.PutUint64(header[:], counter&^sealRandomNonce)
+		dst = append(dst, header[:nonceCounterSize]...)
+		return aead.Seal(dst, makeNonce(aead, header[:nonceCounterSize]), b, header[:nonceCounterSize])
+	}
+	byteOrder.PutUint64(header[:], counter|sealRandomNonce)
+	rand.Read(header[nonceCounterSize:])
+
+	dst = append(dst, header[:]...)
+	return aead.Seal(dst, header[nonceCounterSize:], b, header[:nonceCounterSize])
+}
+
+// open decrypts the datagram b if encryption is turned on. Datagrams whose
+// counter has already been seen are replays and return nil without an error.
+func (c *Connection) open(b []byte) ([]byte, error) {
+	if c.recvAEAD == nil {
+		return b, nil
+	}
+
+	plain, err := decrypt(c.recvAEAD, b)
+	if err != nil {
+		return nil, err
+	}
+
+	// only check for replays once the counter is known to be authentic
+	if c.recvNonces.check(byteOrder.Uint64(b) &^ sealRandomNonce) {
+		c.stats.ReplaysDropped++
+		return nil, nil
+	}
+
+	c.remoteLegacySeal = sealedLegacy(b)
+	return plain, nil
+}
+
+// decrypt opens the datagram b with aead without checking for replays.
+func decrypt(aead cipher.AEAD, b []byte) ([]byte, error) {
+	if len(b) < nonceCounterSize+aead.Overhead() {
+		return nil, ErrDecryptFailed
+	}
+	counter := b[:nonceCounterSize]
+	nonce, sealed := makeNonce(aead, counter), b[nonceCounterSize:]
+	if !sealedLegacy(b) {
+		if len(sealed) < nonceSize+aead.Overhead() {
+			return nil, ErrDecryptFailed
+		}
+		nonce, sealed = sealed[:nonceSize], sealed[nonceSize:]
+	}
+	plain, err := aead.Open(nil, nonce, sealed, counter)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plain, nil
+}
+
+// sealedLegacy returns true if the encrypted datagram b was sealed the way
+// protocol version 1 did. b must hold at least the counter.
+func sealedLegacy(b []byte) bool {
+	return byteOrder.Uint64(b)&sealRandomNonce == 0
+}
+
+// replayWindow remembers the counters of the most recent datagrams opened.
+// Unlike a dupeWindow it compares the whole 64-bit counter, since counters
+// jump ahead by the time that passed when the remote side restarts.
+type replayWindow struct {
+	newest  uint64
+	started bool
+	seen    dupeWindow
+}
+
+// check records the counter and returns true if it's a replay, which
+// includes counters too old for the window to remember.
+func (w *replayWindow) check(counter uint64) bool {
+	if w.started {
+		if counter+dupeWindowSize <= w.newest {
+			return true
+		}
+		if counter >= w.newest+dupeWindowSize {
+			w.seen = dupeWindow{}
+		}
+	}
+	if !w.started || counter > w.newest {
+		w.newest = counter
+		w.started = true
+	}
+	return w.seen.check(uint32(counter))
+}
@@ -0,0 +1,280 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	cryptoTestPort = 42055
+)
+
+func TestEncryptedConnection(t *testing.T) {
+	clientKey := bytes.Repeat([]byte{0x11}, 32)
+	serverKey := bytes.Repeat([]byte{0x22}, 32)
+
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", cryptoTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	err = server.SetEncryptionKeys(serverKey, clientKey)
+	if err != nil {
+		t.Fatalf("Failed to set the server's keys.\n%v", err)
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", cryptoTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	err = client.SetEncryptionKeys(clientKey, serverKey)
+	if err != nil {
+		t.Fatalf("Failed to set the client's keys.\n%v", err)
+	}
+
+	// send a packet and keep a copy of what went on the wire
+	testPayload := []byte("SECRET PING")
+	packet := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload)
+	err = client.Send(packet, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	wire := append([]byte(nil), client.frameBuffer...)
+	if bytes.Contains(wire, testPayload) {
+		t.Errorf("The payload was sent in plaintext.")
+	}
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server failed to read the encrypted packet.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != string(testPayload) {
+		t.Errorf("Server read the wrong payload: %q", string(p.Payload[:p.PayloadSize]))
+	}
+
+	// replaying the same datagram gets dropped
+	client.Socket.WriteTo(wire, client.RemoteAddress)
+
+	// tampering with any byte gets rejected
+	wire[len(wire)/2] ^= 0x01
+	client.Socket.WriteTo(wire, client.RemoteAddress)
+	_, err = server.Read()
+	if !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("Expected a decrypt failure but got: %v", err)
+	}
+	if server.GetStats().ReplaysDropped != 1 || server.GetStats().DecryptFailures != 1 {
+		t.Errorf("Server counted %d replays and %d decrypt failures.",
+			server.GetStats().ReplaysDropped, server.GetStats().DecryptFailures)
+	}
+
+	// and replies work the other way
+	pong := []byte("SECRET PONG")
+	err = server.Send(NewPacket(0, 0, 0, 0, 0, uint32(len(pong)), pong), true, p.RemoteAddress)
+	if err != nil {
+		t.Fatalf("Server failed to send data.\n%v", err)
+	}
+	client.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err = client.Read()
+	if err != nil || string(p.Payload[:p.PayloadSize]) != string(pong) {
+		t.Fatalf("Client failed to read the encrypted reply.\n%v", err)
+	}
+
+	// an unencrypted sender gets rejected
+	client.ClearEncryptionKeys()
+	client.Send(packet, true, nil)
+	_, err = server.Read()
+	if !errors.Is(err, ErrDecryptFailed) {
+		t.Errorf("Expected a decrypt failure for a plaintext packet but got: %v", err)
+	}
+}
+
+func TestEncryptionKeySizes(t *testing.T) {
+	c := New(0)
+	if err := c.SetEncryptionKeys(make([]byte, 16), make([]byte, 15)); err == nil {
+		t.Errorf("A 15 byte key should be rejected.")
+	}
+	if c.IsEncrypted() {
+		t.Errorf("A failed key change shouldn't turn on encryption.")
+	}
+	if err := c.SetEncryptionKeys(make([]byte, 16), make([]byte, 24)); err != nil {
+		t.Errorf("16 and 24 byte keys should be accepted.\n%v", err)
+	}
+}
+
+// TestEncryptionNonces makes sure connections sharing the same keys never
+// seal two packets with the same nonce, even when the keys are set again.
+func TestEncryptionNonces(t *testing.T) {
+	key := bytes.Repeat([]byte{0x33}, 32)
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		c := New(0)
+		for j := 0; j < 1000; j++ {
+			if j%250 == 0 {
+				if err := c.SetEncryptionKeys(key, key); err != nil {
+					t.Fatalf("Failed to set the keys.\n%v", err)
+				}
+			}
+			b := c.seal(nil, []byte("PING"), c.sendAEAD, false)
+			nonce := string(b[nonceCounterSize : nonceCounterSize+nonceSize])
+			if seen[nonce] {
+				t.Fatalf("Connection %d reused a nonce on packet %d.", i, j)
+			}
+			seen[nonce] = true
+		}
+	}
+}
+
+// TestEncryptedSessionReplay makes sure a packet from one session can't be
+// replayed into the next one between the same addresses and keys.
+func TestEncryptedSessionReplay(t *testing.T) {
+	clientKey := bytes.Repeat([]byte{0x11}, 32)
+	serverKey := bytes.Repeat([]byte{0x22}, 32)
+
+	network := NewMemoryNetwork()
+	listenerConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	listener := NewTransportConnection(testServerBufferSize, listenerConn, nil)
+	defer listener.Close()
+	listener.RequireHandshake = true
+	listener.ReadTimeout = time.Millisecond
+	listener.SetEncryptionKeys(serverKey, clientKey)
+
+	var read []string
+	listener.OnPacketRead = func(c *Connection, p *Packet) {
+		read = append(read, string(p.Payload[:p.PayloadSize]))
+	}
+
+	var clientAddr string
+	connect := func() *Connection {
+		clientConn, err := network.Listen(clientAddr)
+		if err != nil {
+			t.Fatalf("Failed to listen on the memory network.\n%v", err)
+		}
+		clientAddr = clientConn.LocalAddr().String()
+		client := NewTransportConnection(testServerBufferSize, clientConn, listenerConn.LocalAddr())
+		client.ReadTimeout = time.Millisecond
+		client.SetEncryptionKeys(clientKey, serverKey)
+		if err = client.Connect(nil); err != nil {
+			t.Fatalf("Client failed to start the handshake.\n%v", err)
+		}
+		ok := tickUntil(listener, client, time.Second*2, func() bool {
+			return listener.State() == StateConnected && client.State() == StateConnected
+		})
+		if !ok {
+			t.Fatalf("Handshake did not complete (listener: %v, client: %v).", listener.State(), client.State())
+		}
+		return client
+	}
+
+	// the first session sends a packet, which gets captured
+	client := connect()
+	testPayload := []byte("SECRET PING")
+	if err = client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil); err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	wire := append([]byte(nil), client.frameBuffer...)
+	tickUntil(listener, client, time.Second, func() bool {
+		return len(read) == 1
+	})
+	client.Disconnect(DisconnectShutdown)
+	tickUntil(listener, client, time.Second, func() bool {
+		return listener.State() != StateConnected
+	})
+
+	// the second session from the same address doesn't accept it again
+	client = connect()
+	defer client.Close()
+	client.Socket.WriteTo(wire, client.RemoteAddress)
+	tickUntil(listener, client, time.Millisecond*50, func() bool {
+		return len(read) > 1
+	})
+	if len(read) != 1 {
+		t.Errorf("The packet from the first session was read again in the second.")
+	}
+	if listener.GetStats().DecryptFailures == 0 {
+		t.Errorf("The replayed packet should have failed to decrypt.")
+	}
+}
+
+// TestEncryptedPeerRestart makes sure a remote side without a session that
+// restarts with the same keys isn't mistaken for a stream of replays.
+func TestEncryptedPeerRestart(t *testing.T) {
+	clientKey := bytes.Repeat([]byte{0x11}, 32)
+	serverKey := bytes.Repeat([]byte{0x22}, 32)
+
+	network := NewMemoryNetwork()
+	serverConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	server := NewTransportConnection(testServerBufferSize, serverConn, nil)
+	defer server.Close()
+	server.SetEncryptionKeys(serverKey, clientKey)
+
+	testPayload := []byte("SECRET PING")
+	clientAddr := ""
+	for run := 0; run < 2; run++ {
+		clientConn, err := network.Listen(clientAddr)
+		if err != nil {
+			t.Fatalf("Failed to listen on the memory network.\n%v", err)
+		}
+		clientAddr = clientConn.LocalAddr().String()
+		client := NewTransportConnection(testServerBufferSize, clientConn, serverConn.LocalAddr())
+		client.SetEncryptionKeys(clientKey, serverKey)
+		for i := 0; i < 3; i++ {
+			if err = client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil); err != nil {
+				t.Fatalf("Client failed to send data.\n%v", err)
+			}
+			serverConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+			if _, err = server.Read(); err != nil {
+				t.Fatalf("Run %d: server failed to read packet %d.\n%v", run, i, err)
+			}
+		}
+		client.Close()
+	}
+	if server.GetStats().ReplaysDropped != 0 {
+		t.Errorf("Server dropped %d packets from the restarted client as replays.", server.GetStats().ReplaysDropped)
+	}
+}
+
+// TestEncryptionLegacyFormat checks that sessions on protocol version 1 seal
+// packets the way that version did and that both formats can be opened.
+func TestEncryptionLegacyFormat(t *testing.T) {
+	clientKey := bytes.Repeat([]byte{0x11}, 32)
+	serverKey := bytes.Repeat([]byte{0x22}, 32)
+	sender := New(0)
+	sender.SetEncryptionKeys(clientKey, serverKey)
+	receiver := New(0)
+	receiver.SetEncryptionKeys(serverKey, clientKey)
+
+	testPayload := []byte("PING")
+	p := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload)
+	for _, version := range []uint8{legacyVersion, ProtocolVersion} {
+		sender.setSession(version, 0)
+		b := sender.seal(nil, testPayload, sender.sendAEAD, sender.sealsLegacy(p))
+		legacy := version < randomNonceVersion
+		if sealedLegacy(b) != legacy {
+			t.Errorf("Version %d sealed a packet in the wrong format (legacy: %v).", version, sealedLegacy(b))
+		}
+		if legacy && len(b) != nonceCounterSize+len(testPayload)+sender.sendAEAD.Overhead() {
+			t.Errorf("Version %d packet is %d bytes, which doesn't match the legacy format.", version, len(b))
+		}
+		plain, err := receiver.open(b)
+		if err != nil || !bytes.Equal(plain, testPayload) {
+			t.Errorf("Failed to open the version %d packet (%q).\n%v", version, plain, err)
+		}
+		if receiver.remoteLegacySeal != legacy {
+			t.Errorf("Receiver should answer the version %d handshake with legacy %v.", version, legacy)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"fmt"
+	"time"
+)
+
+// DisconnectReason is sent along with a disconnect message to tell the remote
+// side why the session ended.
+type DisconnectReason uint8
+
+const (
+	// DisconnectShutdown means the remote side is shutting down normally.
+	DisconnectShutdown DisconnectReason = iota + 1
+
+	// DisconnectKicked means the remote side dropped this connection on purpose.
+	DisconnectKicked
+
+	// DisconnectTimeout means the remote side hasn't heard from this
+	// connection within its IdleTimeout.
+	DisconnectTimeout
+
+	// DisconnectProtocolError means the remote side received something it
+	// couldn't make sense of.
+	DisconnectProtocolError
+
+	// DisconnectBanned means the remote side has banned this connection.
+	DisconnectBanned
+
+	// DisconnectUser is the first reason code available for application use.
+	DisconnectUser DisconnectReason = 128
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectShutdown:
+		return "shutdown"
+	case DisconnectKicked:
+		return "kicked"
+	case DisconnectTimeout:
+		return "timeout"
+	case DisconnectProtocolError:
+		return "protocol error"
+	case DisconnectBanned:
+		return "banned"
+	}
+	if r >= DisconnectUser {
+		return fmt.Sprintf("user(%d)", uint8(r-DisconnectUser))
+	}
+	return fmt.Sprintf("reason(%d)", uint8(r))
+}
+
+// DisconnectEvent is the callback type used when the remote side ends the session.
+type DisconnectEvent func(c *Connection, reason DisconnectReason)
+
+const (
+	// disconnectPacketCount is how many disconnect packets are sent; there's no
+	// ack for them, so a few are sent in the hope that one makes it.
+	disconnectPacketCount = 3
+)
+
+// Disconnect tells the remote side that the session is over by sending it a
+// small burst of disconnect packets with the reason supplied and then ends
+// the session. Server peers are removed from their Server, connections
+// requiring a handshake go back to waiting for a new one and all other
+// connections are closed.
+func (c *Connection) Disconnect(reason DisconnectReason) error {
+	c.mu.Lock()
+	defer c.unlock()
+	if !c.hasSession() {
+		return fmt.Errorf("No remote side to disconnect from.")
+	}
+
+	err := c.sendDisconnect(reason)
+	c.endSession()
+	return err
+}
+
+// sendDisconnect sends the burst of disconnect packets to the remote address.
+func (c *Connection) sendDisconnect(reason DisconnectReason) error {
+	var err error
+	for i := 0; i < disconnectPacketCount; i++ {
+		sendErr := c.sendControl(ctrlDisconnect, []byte{byte(reason)}, c.RemoteAddress)
+		if sendErr != nil {
+			err = sendErr
+		}
+	}
+	return err
+}
+
+// handleDisconnect fires OnDisconnected and ends the session.
+func (c *Connection) handleDisconnect(reason DisconnectReason) {
+	c.state = StateDisconnected
+	if c.OnDisconnected != nil {
+		c.queueEvent(func() { c.OnDisconnected(c, reason) })
+	}
+	c.endSession()
+}
+
+// endSession drops the connection's session with the remote side.
+func (c *Connection) endSession() {
+	c.state = StateDisconnected
+	c.failReliable()
+	c.resetChannels()
+	c.resetFragments()
+	c.clearSessionKeys()
+
+	switch {
+	case c.server != nil:
+		// the server is told once the connection is unlocked
+		c.isOpen = false
+		c.queueEvent(func() { c.server.RemovePeer(c) })
+	case c.RequireHandshake:
+		// a listening connection goes back to waiting for a handshake
+		c.RemoteAddress = nil
+		c.lastSeenSeq = 0
+		c.lastAckMask = 0
+		c.lastRecvTime = time.Time{}
+	case c.sharedSocket:
+		// a clone leaves the Socket open for the connection it came from
+		c.stop()
+	default:
+		c.close()
+	}
+}
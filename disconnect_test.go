@@ -0,0 +1,123 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	disconnectTestPort = 42020
+)
+
+func disconnectTestSetup(t *testing.T, port int) (*Server, *Connection) {
+	server, err := NewServer(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		server.Close()
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+
+	// say hello so the server has a peer for the client
+	testPayload := []byte("PING")
+	client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = server.Read()
+	if err != nil || server.GetPeerCount() != 1 {
+		server.Close()
+		client.Close()
+		t.Fatalf("Server failed to read the client's hello.\n%v", err)
+	}
+
+	return server, client
+}
+
+func TestClientDisconnect(t *testing.T) {
+	server, client := disconnectTestSetup(t, disconnectTestPort)
+	defer server.Close()
+
+	var gotReason DisconnectReason
+	server.ForEachPeer(func(peer *Connection) bool {
+		peer.OnDisconnected = func(c *Connection, reason DisconnectReason) {
+			gotReason = reason
+		}
+		return true
+	})
+	left := false
+	server.OnPeerLeft = func(s *Server, peer *Connection) {
+		left = true
+	}
+
+	err := client.Disconnect(DisconnectShutdown)
+	if err != nil {
+		t.Fatalf("Client failed to disconnect.\n%v", err)
+	}
+	if client.IsOpen() {
+		t.Errorf("Client should be closed after disconnecting.")
+	}
+
+	endTime := time.Now().Add(time.Second)
+	for time.Now().Before(endTime) && !left {
+		server.Tick()
+	}
+	if !left || server.GetPeerCount() != 0 {
+		t.Fatalf("Server didn't drop the disconnected client.")
+	}
+	if gotReason != DisconnectShutdown {
+		t.Errorf("Server got the wrong disconnect reason: %v", gotReason)
+	}
+
+	// the rest of the disconnect burst shouldn't bring the peer back
+	for i := 0; i < disconnectPacketCount; i++ {
+		server.Tick()
+	}
+	if server.GetPeerCount() != 0 {
+		t.Errorf("Server rejoined a peer from its disconnect packets.")
+	}
+}
+
+func TestServerKick(t *testing.T) {
+	server, client := disconnectTestSetup(t, disconnectTestPort+1)
+	defer server.Close()
+	defer client.Close()
+
+	var gotReason DisconnectReason
+	client.OnDisconnected = func(c *Connection, reason DisconnectReason) {
+		gotReason = reason
+	}
+
+	server.ForEachPeer(func(peer *Connection) bool {
+		err := peer.Disconnect(DisconnectUser + 3)
+		if err != nil {
+			t.Errorf("Server failed to kick the client.\n%v", err)
+		}
+		return true
+	})
+	if server.GetPeerCount() != 0 {
+		t.Errorf("Server should have no peers after the kick.")
+	}
+	if !server.IsOpen() {
+		t.Errorf("Kicking a peer should not close the server.")
+	}
+
+	endTime := time.Now().Add(time.Second)
+	for time.Now().Before(endTime) && client.IsOpen() {
+		client.Tick()
+	}
+	if client.IsOpen() {
+		t.Fatalf("Client is still open after being kicked.")
+	}
+	if gotReason != DisconnectUser+3 {
+		t.Errorf("Client got the wrong disconnect reason: %v", gotReason)
+	}
+	if gotReason.String() != "user(3)" {
+		t.Errorf("Disconnect reason has the wrong string: %s", gotReason)
+	}
+}
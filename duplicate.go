@@ -0,0 +1,95 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+const (
+	// dupeWindowSize is how many of the most recent message ids are
+	// remembered per channel; it must be a multiple of 64.
+	dupeWindowSize = 1024
+)
+
+// dupeWindow remembers which of the most recent ids have been seen.
+type dupeWindow struct {
+	newest  uint32
+	started bool
+	bits    [dupeWindowSize / 64]uint64
+}
+
+// check records the id as seen and returns true if it had already been seen.
+// Ids older than the window can't be told apart from duplicates, so they're
+// reported as duplicates as well.
+func (w *dupeWindow) check(id uint32) bool {
+	if !w.started {
+		w.started = true
+		w.newest = id
+		w.set(id)
+		return false
+	}
+
+	if seqGreaterThan(id, w.newest) {
+		// clear out the ids that are skipped over as the window moves up
+		diff := id - w.newest
+		if diff >= dupeWindowSize {
+			w.bits = [dupeWindowSize / 64]uint64{}
+		} else {
+			for i := uint32(1); i <= diff; i++ {
+				w.clear(w.newest + i)
+			}
+		}
+		w.newest = id
+		w.set(id)
+		return false
+	}
+
+	if w.behind(id) || w.isSet(id) {
+		return true
+	}
+	w.set(id)
+	return false
+}
+
+// has returns true if the id has been seen, without recording it.
+func (w *dupeWindow) has(id uint32) bool {
+	if !w.started || seqGreaterThan(id, w.newest) {
+		return false
+	}
+	if w.newest-id >= dupeWindowSize {
+		return true
+	}
+	return w.isSet(id)
+}
+
+// behind returns true if the id is older than anything the window remembers.
+func (w *dupeWindow) behind(id uint32) bool {
+	return w.started && !seqGreaterThan(id, w.newest) && w.newest-id >= dupeWindowSize
+}
+
+func (w *dupeWindow) set(id uint32) {
+	i := id % dupeWindowSize
+	w.bits[i/64] |= 1 << (i % 64)
+}
+
+func (w *dupeWindow) clear(id uint32) {
+	i := id % dupeWindowSize
+	w.bits[i/64] &^= 1 << (i % 64)
+}
+
+func (w *dupeWindow) isSet(id uint32) bool {
+	i := id % dupeWindowSize
+	return w.bits[i/64]&(1<<(i%64)) != 0
+}
+
+// isDuplicate returns true if a packet with the same message id has already
+// been received on the packet's channel. Packets without a message id can't
+// be told apart and are never considered duplicates.
+func (c *Connection) isDuplicate(p *Packet) bool {
+	if !c.DropDuplicates || !p.hasMsgId {
+		return false
+	}
+	if c.getChannel(p.Chan).seen.check(p.MsgId) {
+		c.stats.DuplicatesDropped++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	duplicateTestPort = 42030
+)
+
+func TestDupeWindow(t *testing.T) {
+	var w dupeWindow
+
+	tests := []struct {
+		id   uint32
+		dupe bool
+	}{
+		{5, false},
+		{5, true},
+		{3, false},
+		{3, true},
+		{6, false},
+		{4, false},
+		{6, true},
+		{5 + dupeWindowSize, false},
+		{5, true}, // too old to tell, so it's treated as a duplicate
+		{6 + dupeWindowSize, false},
+		{10 + dupeWindowSize*3, false},
+		{6 + dupeWindowSize, true},
+	}
+	for _, test := range tests {
+		if w.check(test.id) != test.dupe {
+			t.Errorf("Dupe window check of %d should have returned %v.", test.id, test.dupe)
+		}
+	}
+}
+
+func TestDuplicateSuppression(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", duplicateTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", duplicateTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+
+	// send a reliable packet and resend it twice without waiting for an ack
+	const retryCount = 2
+	testPayload := []byte("PING")
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Millisecond, retryCount)
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	for i := 0; i < retryCount; i++ {
+		time.Sleep(time.Millisecond * 2)
+		client.RetryReliablePackets()
+	}
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	p, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server failed to read the first copy.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != "PING" {
+		t.Errorf("Server read the wrong payload: %q", string(p.Payload[:p.PayloadSize]))
+	}
+
+	p, err = server.Read()
+	if err == nil {
+		t.Errorf("Server read a duplicate of the reliable packet (seq %d).", p.Seq)
+	}
+	if server.GetStats().DuplicatesDropped != retryCount {
+		t.Errorf("Server should have dropped %d duplicates but dropped %d.",
+			retryCount, server.GetStats().DuplicatesDropped)
+	}
+}
+
+// TestDuplicatePeerRestart makes sure a remote side without a session that
+// restarts on the same address and numbers its messages from 0 again isn't
+// mistaken for a stream of duplicates.
+func TestDuplicatePeerRestart(t *testing.T) {
+	network := NewMemoryNetwork()
+	serverConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	server := NewTransportConnection(testServerBufferSize, serverConn, nil)
+	defer server.Close()
+	server.SetChannelMode(1, ReliableUnordered)
+
+	testPayload := []byte("PING")
+	clientAddr := ""
+	for run := 0; run < 2; run++ {
+		clientConn, err := network.Listen(clientAddr)
+		if err != nil {
+			t.Fatalf("Failed to listen on the memory network.\n%v", err)
+		}
+		clientAddr = clientConn.LocalAddr().String()
+		client := NewTransportConnection(testServerBufferSize, clientConn, serverConn.LocalAddr())
+		client.SetChannelMode(1, ReliableUnordered)
+		if run == 0 {
+			// the first run has been going for a while
+			client.getChannel(1).nextMsgId = dupeWindowSize * 2
+		}
+
+		failed := false
+		rp := NewPacket(42, 0, 1, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Millisecond*10, 2)
+		rp.OnFailToAck = func(c *Connection, rp *ReliablePacket) {
+			failed = true
+		}
+		if err = client.SendReliable(rp, true, nil); err != nil {
+			t.Fatalf("Client failed to send data.\n%v", err)
+		}
+		serverConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		p, err := server.Read()
+		if err != nil {
+			t.Fatalf("Run %d: server failed to read the packet.\n%v", run, err)
+		}
+		if p.MsgId != rp.Packet.MsgId {
+			t.Errorf("Run %d: server read msg %d but expected %d.", run, p.MsgId, rp.Packet.MsgId)
+		}
+
+		// the server's reply carries the ack back
+		err = server.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, clientConn.LocalAddr())
+		if err != nil {
+			t.Fatalf("Server failed to send data.\n%v", err)
+		}
+		clientConn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		if _, err = client.Read(); err != nil {
+			t.Fatalf("Run %d: client failed to read the reply.\n%v", run, err)
+		}
+		if client.GetAcksNeededLen() != 0 || failed {
+			t.Errorf("Run %d: the packet should have been acked (failed: %v).", run, failed)
+		}
+		client.Close()
+	}
+	if server.GetStats().DuplicatesDropped != 0 {
+		t.Errorf("Server dropped %d packets from the restarted client as duplicates.", server.GetStats().DuplicatesDropped)
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AddressFilter decides which remote addresses a Connection or Server reads
+// packets from. Accept is called for every datagram before anything else is
+// done with it and datagrams from addresses it refuses are dropped.
+type AddressFilter interface {
+	Accept(addr net.Addr) bool
+}
+
+// FilterRule is a single entry of a Banlist.
+type FilterRule struct {
+	// Network is the range of addresses the rule matches; single IPs are
+	// stored as a /32 or /128 network.
+	Network *net.IPNet
+
+	// Allow indicates if the rule is part of the allowlist instead of a ban.
+	Allow bool
+
+	// Expires is when a temporary ban ends. A zero value never expires.
+	Expires time.Time
+
+	// Dropped is the number of datagrams dropped because of this rule.
+	Dropped uint64
+}
+
+// String returns the rule in the format used by Banlist.Save().
+func (r *FilterRule) String() string {
+	kind := "ban"
+	if r.Allow {
+		kind = "allow"
+	}
+	if r.Expires.IsZero() {
+		return fmt.Sprintf("%s %s", kind, r.Network)
+	}
+	return fmt.Sprintf("%s %s %s", kind, r.Network, r.Expires.UTC().Format(time.RFC3339))
+}
+
+// expired returns true if the rule is a temporary ban that has ended.
+func (r *FilterRule) expired(t time.Time) bool {
+	return !r.Expires.IsZero() && !t.Before(r.Expires)
+}
+
+// Banlist is an AddressFilter made up of bans and an allowlist. Addresses
+// matching a ban are refused. If the allowlist has any rules, addresses that
+// don't match one of them are refused as well. Addresses without an IP, such
+// as those of Unix sockets, never match a rule. A Banlist is safe for
+// concurrent use, so rules can be changed while connections are reading.
+type Banlist struct {
+	// Clock, if set, is used in place of the real time for bans that expire.
+	Clock Clock
+
+	rules             []*FilterRule
+	notAllowedDropped uint64
+	mu                sync.Mutex
+}
+
+// NewBanlist creates an empty Banlist that accepts every address.
+func NewBanlist() *Banlist {
+	return new(Banlist)
+}
+
+// Accept returns true if packets from the address should be read.
+func (b *Banlist) Accept(addr net.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := clockNow(b.Clock)
+	ip := addrIP(addr)
+	hasAllowlist, allowed := false, false
+	for _, r := range b.rules {
+		if r.expired(t) {
+			continue
+		}
+		match := ip != nil && r.Network.Contains(ip)
+		if r.Allow {
+			hasAllowlist = true
+			allowed = allowed || match
+			continue
+		}
+		if match {
+			r.Dropped++
+			return false
+		}
+	}
+
+	if hasAllowlist && !allowed {
+		b.notAllowedDropped++
+		return false
+	}
+	return true
+}
+
+// Ban refuses the address, which may be a single IP or a CIDR range. A
+// duration of zero bans it permanently; otherwise the ban expires after the
+// duration has passed. Banning an address that's already banned replaces
+// the old ban.
+func (b *Banlist) Ban(address string, duration time.Duration) error {
+	var expires time.Time
+	if duration > 0 {
+		expires = clockNow(b.Clock).Add(duration)
+	}
+	return b.addRule(address, false, expires)
+}
+
+// Unban removes the ban for the address, returning false if it wasn't banned.
+func (b *Banlist) Unban(address string) bool {
+	return b.removeRule(address, false)
+}
+
+// Allow adds the address, which may be a single IP or a CIDR range, to the
+// allowlist.
+func (b *Banlist) Allow(address string) error {
+	return b.addRule(address, true, time.Time{})
+}
+
+// Disallow removes the address from the allowlist, returning false if it
+// wasn't on it.
+func (b *Banlist) Disallow(address string) bool {
+	return b.removeRule(address, true)
+}
+
+// GetNotAllowedDropped returns the number of datagrams dropped because their
+// address wasn't on a non-empty allowlist.
+func (b *Banlist) GetNotAllowedDropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.notAllowedDropped
+}
+
+// IsBanned returns true if the address is covered by a ban that hasn't expired.
+func (b *Banlist) IsBanned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := clockNow(b.Clock)
+	for _, r := range b.rules {
+		if !r.Allow && !r.expired(t) && r.Network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRules returns a copy of the rules that haven't expired, along with
+// their drop counters.
+func (b *Banlist) GetRules() []FilterRule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	rules := make([]FilterRule, len(b.rules))
+	for i, r := range b.rules {
+		rules[i] = *r
+	}
+	return rules
+}
+
+// Load reads rules from the file and adds them to the Banlist. Each line
+// holds "ban" or "allow" followed by an IP or CIDR range and, for temporary
+// bans, an RFC 3339 expiry time. Blank lines and lines starting with # are
+// skipped.
+func (b *Banlist) Load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Failed to open the banlist file: %s\n%v", filename, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 || (fields[0] != "ban" && fields[0] != "allow") {
+			return fmt.Errorf("Malformed banlist rule on line %d: %q", line, text)
+		}
+		var expires time.Time
+		if len(fields) == 3 {
+			expires, err = time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				return fmt.Errorf("Malformed expiry time on line %d: %q\n%v", line, text, err)
+			}
+		}
+		err = b.addRule(fields[1], fields[0] == "allow", expires)
+		if err != nil {
+			return fmt.Errorf("Malformed address on line %d.\n%v", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read the banlist file: %s\n%v", filename, err)
+	}
+	return nil
+}
+
+// Save writes the rules that haven't expired to the file in the format
+// read by Load().
+func (b *Banlist) Save(filename string) error {
+	b.mu.Lock()
+	b.prune()
+	var sb strings.Builder
+	for _, r := range b.rules {
+		sb.WriteString(r.String())
+		sb.WriteByte('\n')
+	}
+	b.mu.Unlock()
+
+	err := os.WriteFile(filename, []byte(sb.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write the banlist file: %s\n%v", filename, err)
+	}
+	return nil
+}
+
+// addRule adds a rule for the address, replacing any rule of the same kind
+// for the same network.
+func (b *Banlist) addRule(address string, allow bool, expires time.Time) error {
+	network, err := parseNetwork(address)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.rules {
+		if r.Allow == allow && r.Network.String() == network.String() {
+			r.Expires = expires
+			return nil
+		}
+	}
+	b.rules = append(b.rules, &FilterRule{Network: network, Allow: allow, Expires: expires})
+	return nil
+}
+
+// removeRule removes the rule of the kind specified for the address.
+func (b *Banlist) removeRule(address string, allow bool) bool {
+	network, err := parseNetwork(address)
+	if err != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, r := range b.rules {
+		if r.Allow == allow && r.Network.String() == network.String() {
+			b.rules = append(b.rules[:i], b.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// prune drops the temporary bans that have expired.
+func (b *Banlist) prune() {
+	t := clockNow(b.Clock)
+	rules := b.rules[:0]
+	for _, r := range b.rules {
+		if !r.expired(t) {
+			rules = append(rules, r)
+		}
+	}
+	b.rules = rules
+}
+
+// parseNetwork parses a CIDR range or a single IP, which is turned into a
+// network holding just that address.
+func parseNetwork(address string) (*net.IPNet, error) {
+	if strings.Contains(address, "/") {
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse the address range: %s\n%v", address, err)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("Failed to parse the address: %s", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// addrIP returns the IP of the address, or nil if it doesn't have one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
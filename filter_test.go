@@ -0,0 +1,138 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	filterTestPort = 42065
+)
+
+func TestBanlistRules(t *testing.T) {
+	bl := NewBanlist()
+	addr := func(ip string) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+
+	if !bl.Accept(addr("10.1.2.3")) {
+		t.Errorf("An empty banlist should accept every address.")
+	}
+
+	if err := bl.Ban("10.0.0.0/8", 0); err != nil {
+		t.Fatalf("Failed to ban a range.\n%v", err)
+	}
+	if err := bl.Ban("192.168.1.5", time.Millisecond*50); err != nil {
+		t.Fatalf("Failed to ban an address.\n%v", err)
+	}
+	if err := bl.Ban("not an address", 0); err == nil {
+		t.Errorf("Banning garbage should fail.")
+	}
+
+	if bl.Accept(addr("10.1.2.3")) || bl.Accept(addr("192.168.1.5")) {
+		t.Errorf("Banned addresses were accepted.")
+	}
+	if !bl.Accept(addr("192.168.1.6")) {
+		t.Errorf("An address next to a single IP ban was refused.")
+	}
+
+	// temporary bans run out
+	time.Sleep(time.Millisecond * 60)
+	if !bl.Accept(addr("192.168.1.5")) {
+		t.Errorf("An expired ban still refused the address.")
+	}
+	rules := bl.GetRules()
+	if len(rules) != 1 || rules[0].Dropped != 1 {
+		t.Fatalf("Expected the range ban with 1 drop but got: %v", rules)
+	}
+
+	if !bl.Unban("10.0.0.0/8") || bl.Unban("10.0.0.0/8") {
+		t.Errorf("Unban should remove the ban exactly once.")
+	}
+	if !bl.Accept(addr("10.1.2.3")) {
+		t.Errorf("An unbanned address was refused.")
+	}
+
+	// once there's an allowlist, everything else is refused
+	bl.Allow("172.16.0.0/12")
+	bl.Ban("172.16.0.9", 0)
+	if !bl.Accept(addr("172.16.4.4")) {
+		t.Errorf("An allowed address was refused.")
+	}
+	if bl.Accept(addr("8.8.8.8")) || bl.GetNotAllowedDropped() != 1 {
+		t.Errorf("An address not on the allowlist was accepted.")
+	}
+	if bl.Accept(addr("172.16.0.9")) {
+		t.Errorf("A ban should win over the allowlist.")
+	}
+
+	// and the rules survive a round trip through a file
+	bl.Ban("2001:db8::1", time.Hour)
+	filename := filepath.Join(t.TempDir(), "banlist.txt")
+	if err := bl.Save(filename); err != nil {
+		t.Fatalf("%v", err)
+	}
+	loaded := NewBanlist()
+	if err := loaded.Load(filename); err != nil {
+		t.Fatalf("%v", err)
+	}
+	before, after := bl.GetRules(), loaded.GetRules()
+	if len(before) != len(after) {
+		t.Fatalf("Loaded %d rules but saved %d.", len(after), len(before))
+	}
+	for i := range before {
+		if before[i].String() != after[i].String() {
+			t.Errorf("Rule %d changed from %q to %q.", i, before[i].String(), after[i].String())
+		}
+	}
+}
+
+func TestFilteredConnection(t *testing.T) {
+	server, err := NewServer(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", filterTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	bl := NewBanlist()
+	bl.Ban("127.0.0.1", 0)
+	server.Filter = bl
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", filterTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+
+	testPayload := []byte("PING")
+	client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	_, _, err = server.Read()
+	if err == nil {
+		t.Fatalf("Server read a packet from a banned address.")
+	}
+	if server.GetStats().FilteredDropped != 1 || bl.GetRules()[0].Dropped != 1 {
+		t.Errorf("The dropped packet wasn't counted (%d, %d).",
+			server.GetStats().FilteredDropped, bl.GetRules()[0].Dropped)
+	}
+	if len(server.peers) != 0 {
+		t.Errorf("Server created a peer for a banned address.")
+	}
+
+	// lifting the ban lets the client in
+	bl.Unban("127.0.0.1")
+	client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, p, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server failed to read from an unbanned address.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != "PING" {
+		t.Errorf("Server read the wrong payload: %q", string(p.Payload[:p.PayloadSize]))
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	defaultFragmentSize       = 1024
+	defaultMaxFragments       = 256
+	defaultMaxReassemblyBytes = 1024 * 1024
+	defaultFragmentTimeout    = time.Second * 5
+	defaultMaxFragmentGroups  = 64
+
+	// roughly what a partially received packet and each of its fragment
+	// slots take up before any data arrives; it's charged against
+	// MaxReassemblyBytes along with the data
+	fragmentGroupOverhead = 128
+	fragmentPieceOverhead = 24
+
+	// fragment header after the control message type:
+	// channel, flags, message id, group id, index, count
+	fragmentHeaderSize = 1 + 1 + 4 + 4 + 2 + 2
+
+	fragmentFlagMsgId = 0x01
+)
+
+// fragmentGroup collects the fragments of one large packet as they arrive.
+type fragmentGroup struct {
+	ch       uint8
+	hasMsgId bool
+	msgId    uint32
+	pieces   [][]byte
+	got      int
+	size     int
+	overhead int
+	started  time.Time
+}
+
+// fragmentAcks tracks the reliably sent fragments of a ReliablePacket so its
+// events fire once for the whole packet.
+type fragmentAcks struct {
+	parent    *ReliablePacket
+	remaining int
+	failed    bool
+}
+
+// needsFragments returns true if the packet is too large to send in one
+// datagram and has to be split up.
+func (c *Connection) needsFragments(p *Packet) bool {
+	return c.FragmentSize > 0 && p.Chan != ControlChannel && p.PayloadSize > uint32(c.FragmentSize)
+}
+
+// sendFragments splits the packet's payload into FragmentSize pieces and
+// sends each one as a control packet. If parent is set, or ReliableFragments
+// is true, every fragment is sent as its own ReliablePacket so a lost one gets
+// resent by itself; the parent's OnAck fires once all of them are acked and
+// its OnFailToAck fires if any of them fails.
+func (c *Connection) sendFragments(p *Packet, parent *ReliablePacket, remote net.Addr) error {
+	size := int(p.PayloadSize)
+	count := (size + c.FragmentSize - 1) / c.FragmentSize
+	if count > c.MaxFragments || count > 0xFFFF {
+		return fmt.Errorf("Packet payload of %d bytes needs %d fragments; the maximum is %d.", size, count, c.MaxFragments)
+	}
+
+	group := c.nextFragmentGroup
+	c.nextFragmentGroup++
+
+	var acks *fragmentAcks
+	retryInterval, retryCount := c.ReliableRetryInterval, c.ReliableRetryCount
+	if parent != nil {
+		acks = &fragmentAcks{parent: parent, remaining: count}
+		retryInterval, retryCount = parent.RetryInterval, parent.RetryCount
+	} else if c.ReliableFragments {
+		acks = &fragmentAcks{remaining: count}
+	}
+
+	var flags uint8
+	if p.hasMsgId {
+		flags |= fragmentFlagMsgId
+	}
+
+	for i := 0; i < count; i++ {
+		start := i * c.FragmentSize
+		end := start + c.FragmentSize
+		if end > size {
+			end = size
+		}
+
+		body := make([]byte, fragmentHeaderSize, fragmentHeaderSize+end-start)
+		body[0] = p.Chan
+		body[1] = flags
+		byteOrder.PutUint32(body[2:], p.MsgId)
+		byteOrder.PutUint32(body[6:], group)
+		byteOrder.PutUint16(body[10:], uint16(i))
+		byteOrder.PutUint16(body[12:], uint16(count))
+		body = append(body, p.Payload[start:end]...)
+
+		payload := append([]byte{ctrlFragment}, body...)
+		fp := NewPacket(p.ClientId, 0, ControlChannel, 0, 0, uint32(len(payload)), payload)
+
+		var err error
+		if acks != nil {
+			frp := fp.MakeReliable(retryInterval, retryCount)
+			frp.fragments = acks
+			err = c.sendReliable(frp, true, remote)
+		} else {
+			err = c.send(fp, true, remote)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// onAck counts an acknowledged fragment and fires the parent's OnAck once
+// all of them are in.
+func (fa *fragmentAcks) onAck(c *Connection) {
+	fa.remaining--
+	if fa.remaining == 0 && !fa.failed && fa.parent != nil {
+		c.fireAck(fa.parent)
+	}
+}
+
+// onFailToAck fires the parent's OnFailToAck for the first fragment that
+// fails to be acknowledged.
+func (fa *fragmentAcks) onFailToAck(c *Connection) {
+	if fa.failed {
+		return
+	}
+	fa.failed = true
+	if fa.parent != nil {
+		c.fireFailToAck(fa.parent)
+	}
+}
+
+// receiveFragment stores the fragment carried by the control packet p and
+// returns the reassembled packet once every fragment of it has arrived.
+func (c *Connection) receiveFragment(p *Packet) *Packet {
+	body := p.Payload[1:p.PayloadSize]
+	if len(body) < fragmentHeaderSize {
+		c.stats.FragmentsDropped++
+		return nil
+	}
+
+	ch := body[0]
+	hasMsgId := body[1]&fragmentFlagMsgId != 0
+	msgId := byteOrder.Uint32(body[2:])
+	group := byteOrder.Uint32(body[6:])
+	index := int(byteOrder.Uint16(body[10:]))
+	count := int(byteOrder.Uint16(body[12:]))
+	data := body[fragmentHeaderSize:]
+
+	// only the last fragment of a packet can be empty
+	if ch > MaxChannel || count < 1 || index >= count || count > c.MaxFragments ||
+		(len(data) == 0 && index != count-1) {
+		c.stats.FragmentsDropped++
+		return nil
+	}
+
+	// a group far behind the ones already put together means the remote
+	// side started over, otherwise it's a late copy of a finished packet
+	if c.fragmentsDone.behind(group) {
+		c.resetFragments()
+	}
+	if c.fragmentsDone.has(group) {
+		return nil
+	}
+
+	g := c.fragments[group]
+	if g == nil {
+		// a new packet is charged for its bookkeeping up front so that the
+		// first fragments of many packets can't pile up for free
+		overhead := fragmentGroupOverhead + count*fragmentPieceOverhead
+		if len(c.fragments) >= c.MaxFragmentGroups || c.reassemblyBytes+overhead+len(data) > c.MaxReassemblyBytes {
+			c.stats.FragmentsDropped++
+			return nil
+		}
+
+		g = &fragmentGroup{
+			ch:       ch,
+			hasMsgId: hasMsgId,
+			msgId:    msgId,
+			pieces:   make([][]byte, count),
+			overhead: overhead,
+			started:  c.now(),
+		}
+		if c.fragments == nil {
+			c.fragments = make(map[uint32]*fragmentGroup)
+		}
+		c.fragments[group] = g
+		c.reassemblyBytes += overhead
+	}
+	if g.ch != ch || len(g.pieces) != count {
+		c.stats.FragmentsDropped++
+		return nil
+	}
+	if g.pieces[index] != nil {
+		return nil
+	}
+	if c.reassemblyBytes+len(data) > c.MaxReassemblyBytes {
+		c.stats.FragmentsDropped++
+		return nil
+	}
+
+	piece := make([]byte, len(data))
+	copy(piece, data)
+	g.pieces[index] = piece
+	g.got++
+	g.size += len(piece)
+	c.reassemblyBytes += len(piece)
+	if g.got < count {
+		return nil
+	}
+
+	// everything is here, so put the packet back together
+	delete(c.fragments, group)
+	c.reassemblyBytes -= g.size + g.overhead
+	c.fragmentsDone.check(group)
+
+	payload := make([]byte, 0, g.size)
+	for _, piece := range g.pieces {
+		payload = append(payload, piece...)
+	}
+
+	whole := NewPacket(p.ClientId, p.Seq, g.ch, p.AckSeq, p.AckMask, uint32(len(payload)), payload)
+	whole.RemoteAddress = p.RemoteAddress
+	whole.MsgId = g.msgId
+	whole.hasMsgId = g.hasMsgId
+	return whole
+}
+
+// expireFragments drops partially received packets that have been waiting
+// longer than FragmentTimeout.
+func (c *Connection) expireFragments() {
+	t := c.now()
+	for group, g := range c.fragments {
+		if t.Sub(g.started) >= c.FragmentTimeout {
+			delete(c.fragments, group)
+			c.reassemblyBytes -= g.size + g.overhead
+			c.stats.FragmentsDropped += uint64(g.got)
+		}
+	}
+}
+
+// resetFragments forgets every partially received packet.
+func (c *Connection) resetFragments() {
+	c.fragments = nil
+	c.fragmentsDone = dupeWindow{}
+	c.reassemblyBytes = 0
+}
@@ -0,0 +1,213 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	fragmentTestPort = 42045
+)
+
+const (
+	fragmentTestBufferSize = 512 * 1024
+)
+
+func makeFragmentTestPayload(size int) []byte {
+	payload := make([]byte, size)
+	rand.Read(payload)
+	return payload
+}
+
+// fragmentTestPackets splits the packet into fragments using the client
+// connection's settings and returns them as they would be read.
+func fragmentTestPackets(t *testing.T, c *Connection, p *Packet) []*Packet {
+	var packets []*Packet
+	server, err := NewConnection(fragmentTestBufferSize, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+
+	c.RemoteAddress = server.Socket.LocalAddr().(*net.UDPAddr)
+	err = c.Send(p, true, nil)
+	if err != nil {
+		t.Fatalf("Failed to send the fragments.\n%v", err)
+	}
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	for {
+		n, _, err := server.Socket.ReadFrom(server.buffer)
+		if err != nil {
+			break
+		}
+		fp, err := NewPacketFrom(n, server.buffer)
+		if err != nil {
+			t.Fatalf("Failed to read a fragment.\n%v", err)
+		}
+		packets = append(packets, fp)
+	}
+	return packets
+}
+
+// copyFragment returns a copy of the fragment moved to another group and cut
+// down to size bytes of data.
+func copyFragment(fp *Packet, group uint32, size int) *Packet {
+	payload := append([]byte(nil), fp.Payload[:1+fragmentHeaderSize+size]...)
+	byteOrder.PutUint32(payload[1+6:], group)
+	return NewPacket(fp.ClientId, fp.Seq, fp.Chan, 0, 0, uint32(len(payload)), payload)
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	client, err := NewConnection(fragmentTestBufferSize, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.FragmentSize = 100
+
+	testPayload := makeFragmentTestPayload(450)
+	fragments := fragmentTestPackets(t, client, NewPacket(42, 0, 3, 0, 0, uint32(len(testPayload)), testPayload))
+	if len(fragments) != 5 {
+		t.Fatalf("Packet should have been split into 5 fragments but got %d.", len(fragments))
+	}
+
+	// deliver the fragments out of order with a duplicate thrown in
+	c := New(0)
+	order := []int{4, 0, 2, 2, 1}
+	for _, i := range order {
+		if whole := c.receiveFragment(fragments[i]); whole != nil {
+			t.Fatalf("Packet was put together before all fragments arrived.")
+		}
+	}
+	whole := c.receiveFragment(fragments[3])
+	if whole == nil {
+		t.Fatalf("Packet wasn't put together after all fragments arrived.")
+	}
+	if whole.Chan != 3 || !bytes.Equal(whole.Payload[:whole.PayloadSize], testPayload) {
+		t.Errorf("Packet was put back together wrong (chan %d, %d bytes).", whole.Chan, whole.PayloadSize)
+	}
+	if c.reassemblyBytes != 0 || len(c.fragments) != 0 {
+		t.Errorf("Reassembly state wasn't cleaned up (%d bytes, %d groups).", c.reassemblyBytes, len(c.fragments))
+	}
+
+	// late copies of the fragments don't start a new packet
+	if c.receiveFragment(fragments[1]) != nil || len(c.fragments) != 0 {
+		t.Errorf("A late fragment started a new packet.")
+	}
+}
+
+func TestFragmentLimits(t *testing.T) {
+	client, err := NewConnection(fragmentTestBufferSize, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.FragmentSize = 100
+
+	testPayload := makeFragmentTestPayload(450)
+	fragments := fragmentTestPackets(t, client, NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload))
+
+	// the memory cap drops fragments that don't fit; the packet's overhead
+	// is charged along with its data
+	c := New(0)
+	overhead := fragmentGroupOverhead + len(fragments)*fragmentPieceOverhead
+	c.MaxReassemblyBytes = overhead + 250
+	for _, fp := range fragments {
+		if c.receiveFragment(fp) != nil {
+			t.Fatalf("Packet was put together despite the memory cap.")
+		}
+	}
+	// 100 + 100 bytes fit, the next two 100 byte fragments don't, the last 50 bytes do
+	if c.GetStats().FragmentsDropped != 2 || c.reassemblyBytes != overhead+250 {
+		t.Errorf("Memory cap dropped %d fragments, holding %d bytes.", c.GetStats().FragmentsDropped, c.reassemblyBytes)
+	}
+
+	// partial packets time out
+	c.FragmentTimeout = time.Millisecond
+	time.Sleep(time.Millisecond * 2)
+	c.expireFragments()
+	if c.GetStats().FragmentsDropped != 5 || c.reassemblyBytes != 0 || len(c.fragments) != 0 {
+		t.Errorf("Timed out fragments weren't dropped (%d dropped, %d bytes).", c.GetStats().FragmentsDropped, c.reassemblyBytes)
+	}
+
+	// only so many packets can be partially received at once
+	c = New(0)
+	c.MaxFragmentGroups = 2
+	for group := uint32(0); group < 3; group++ {
+		c.receiveFragment(copyFragment(fragments[0], group, 100))
+	}
+	if len(c.fragments) != 2 || c.GetStats().FragmentsDropped != 1 {
+		t.Errorf("Group cap kept %d groups and dropped %d fragments.", len(c.fragments), c.GetStats().FragmentsDropped)
+	}
+
+	// empty fragments are only accepted at the end of a packet
+	c = New(0)
+	c.receiveFragment(copyFragment(fragments[0], 0, 0))
+	if len(c.fragments) != 0 || c.reassemblyBytes != 0 || c.GetStats().FragmentsDropped != 1 {
+		t.Errorf("An empty fragment that wasn't the last one was kept.")
+	}
+
+	// too many fragments can't be sent
+	client.MaxFragments = 4
+	err = client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err == nil {
+		t.Errorf("Sending a packet needing too many fragments should fail.")
+	}
+}
+
+func TestReliableFragments(t *testing.T) {
+	server, err := NewConnection(fragmentTestBufferSize, fmt.Sprintf("127.0.0.1:%d", fragmentTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+
+	client, err := NewConnection(fragmentTestBufferSize, "", fmt.Sprintf("127.0.0.1:%d", fragmentTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+
+	ackCount := 0
+	testPayload := makeFragmentTestPayload(defaultFragmentSize*8 + 10)
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Second, 5)
+	rp.OnAck = func(c *Connection, rp *ReliablePacket) {
+		ackCount++
+	}
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	if client.GetAcksNeededLen() != 9 {
+		t.Errorf("Client should be waiting on acks for 9 fragments but has %d.", client.GetAcksNeededLen())
+	}
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server failed to read data.\n%v", err)
+	}
+	if !bytes.Equal(p.Payload[:p.PayloadSize], testPayload) {
+		t.Fatalf("Server read a payload of %d bytes that doesn't match.", p.PayloadSize)
+	}
+
+	pong := []byte("PONG")
+	server.Send(NewPacket(0, 0, 0, 0, 0, uint32(len(pong)), pong), true, p.RemoteAddress)
+	client.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read()
+	if err != nil {
+		t.Fatalf("Client failed to read data.\n%v", err)
+	}
+
+	if ackCount != 1 || client.GetAcksNeededLen() != 0 {
+		t.Errorf("Packet should be acked once (%d) with no acks waiting (%d).", ackCount, client.GetAcksNeededLen())
+	}
+}
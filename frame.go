@@ -0,0 +1,72 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	// ErrProtocolMismatch is returned when a datagram doesn't start with
+	// the expected ProtocolId, which usually means it came from some other
+	// application.
+	ErrProtocolMismatch = errors.New("Datagram protocol id doesn't match.")
+
+	// ErrBadChecksum is returned when a datagram's CRC32 doesn't match its
+	// contents, which means it was corrupted along the way.
+	ErrBadChecksum = errors.New("Datagram checksum doesn't match.")
+)
+
+const (
+	protocolIdSize = 4
+	checksumSize   = 4
+)
+
+// frameDatagram wraps the encoded packet b with the protocol id, if it's not
+// zero, and a checksum, if requested, appending the datagram to dst.
+func frameDatagram(dst []byte, b []byte, protocolId uint32, useChecksum bool) []byte {
+	if protocolId != 0 {
+		var id [protocolIdSize]byte
+		byteOrder.PutUint32(id[:], protocolId)
+		dst = append(dst, id[:]...)
+	}
+	dst = append(dst, b...)
+	if useChecksum {
+		var sum [checksumSize]byte
+		byteOrder.PutUint32(sum[:], crc32.ChecksumIEEE(dst))
+		dst = append(dst, sum[:]...)
+	}
+	return dst
+}
+
+// unframeDatagram checks the protocol id and checksum of the datagram b and
+// returns the encoded packet inside it. The protocol id is checked first so
+// that traffic from other applications is counted as a mismatch rather than
+// as corruption. Failures are counted in stats.
+func unframeDatagram(b []byte, protocolId uint32, useChecksum bool, stats *ConnectionStats) ([]byte, error) {
+	headerSize := 0
+	if protocolId != 0 {
+		if len(b) < protocolIdSize || byteOrder.Uint32(b) != protocolId {
+			stats.ProtocolMismatches++
+			return nil, ErrProtocolMismatch
+		}
+		headerSize = protocolIdSize
+	}
+
+	if useChecksum {
+		if len(b) < headerSize+checksumSize {
+			stats.BadChecksums++
+			return nil, ErrBadChecksum
+		}
+		end := len(b) - checksumSize
+		if crc32.ChecksumIEEE(b[:end]) != byteOrder.Uint32(b[end:]) {
+			stats.BadChecksums++
+			return nil, ErrBadChecksum
+		}
+		b = b[:end]
+	}
+
+	return b[headerSize:], nil
+}
@@ -0,0 +1,157 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	frameTestPort = 42050
+)
+
+const (
+	frameTestProtocolId = 0x4E504544
+)
+
+func TestFrameDatagram(t *testing.T) {
+	packet := []byte("not really a packet")
+	var stats ConnectionStats
+
+	b := frameDatagram(nil, packet, frameTestProtocolId, true)
+	if len(b) != len(packet)+protocolIdSize+checksumSize {
+		t.Fatalf("Framed datagram has the wrong size: %d", len(b))
+	}
+	unframed, err := unframeDatagram(b, frameTestProtocolId, true, &stats)
+	if err != nil || !bytes.Equal(unframed, packet) {
+		t.Fatalf("Datagram didn't unframe cleanly (%v).", err)
+	}
+
+	// a different protocol id gets rejected
+	_, err = unframeDatagram(frameDatagram(nil, packet, frameTestProtocolId+1, false), frameTestProtocolId, false, &stats)
+	if err != ErrProtocolMismatch || stats.ProtocolMismatches != 1 {
+		t.Errorf("Expected a protocol mismatch but got: %v", err)
+	}
+
+	// even with a checksum that also doesn't match
+	_, err = unframeDatagram(frameDatagram(nil, packet, frameTestProtocolId+1, true), frameTestProtocolId, true, &stats)
+	if err != ErrProtocolMismatch || stats.ProtocolMismatches != 2 {
+		t.Errorf("Expected a protocol mismatch ahead of the checksum but got: %v", err)
+	}
+
+	// any corruption after the protocol id fails the checksum
+	for i := protocolIdSize; i < len(b); i++ {
+		corrupt := append([]byte(nil), b...)
+		corrupt[i] ^= 0x10
+		_, err = unframeDatagram(corrupt, frameTestProtocolId, true, &stats)
+		if err != ErrBadChecksum {
+			t.Errorf("Corrupting byte %d should have failed the checksum but got: %v", i, err)
+		}
+	}
+	if stats.BadChecksums != uint64(len(b)-protocolIdSize) {
+		t.Errorf("Expected %d bad checksums but counted %d.", len(b)-protocolIdSize, stats.BadChecksums)
+	}
+
+	// and so do datagrams too short to hold the frame
+	_, err = unframeDatagram(frameDatagram(nil, []byte{1, 2}, frameTestProtocolId, false), frameTestProtocolId, true, &stats)
+	if err != ErrBadChecksum {
+		t.Errorf("A short datagram should fail the checksum but got: %v", err)
+	}
+	_, err = unframeDatagram([]byte{1, 2}, frameTestProtocolId, true, &stats)
+	if err != ErrProtocolMismatch {
+		t.Errorf("A datagram too short for the protocol id should be a mismatch but got: %v", err)
+	}
+}
+
+func TestFrameRejection(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", frameTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	server.ProtocolId = frameTestProtocolId
+	server.UseChecksum = true
+
+	readCount := 0
+	server.OnPacketRead = func(c *Connection, p *Packet) {
+		readCount++
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", frameTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.ProtocolId = frameTestProtocolId + 1
+	client.UseChecksum = true
+
+	testPayload := []byte("PING")
+	sendPing := func() {
+		err := client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+		if err != nil {
+			t.Fatalf("Client failed to send data.\n%v", err)
+		}
+	}
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+
+	// the wrong protocol id
+	sendPing()
+	_, err = server.Read()
+	if !errors.Is(err, ErrProtocolMismatch) {
+		t.Errorf("Expected a protocol mismatch but got: %v", err)
+	}
+
+	// a corrupted datagram
+	client.ProtocolId = frameTestProtocolId
+	b := frameDatagram(nil, []byte("garbage that won't match"), frameTestProtocolId, false)
+	b = append(b, 0, 0, 0, 0)
+	client.Socket.WriteTo(b, client.RemoteAddress)
+	_, err = server.Read()
+	if !errors.Is(err, ErrBadChecksum) {
+		t.Errorf("Expected a bad checksum but got: %v", err)
+	}
+
+	// and finally the right settings
+	sendPing()
+	p, err := server.Read()
+	if err != nil || string(p.Payload[:p.PayloadSize]) != "PING" {
+		t.Fatalf("Server failed to read a good packet.\n%v", err)
+	}
+
+	stats := server.GetStats()
+	if stats.ProtocolMismatches != 1 || stats.BadChecksums != 1 || readCount != 1 {
+		t.Errorf("Server counted %d mismatches, %d bad checksums and read %d packets.",
+			stats.ProtocolMismatches, stats.BadChecksums, readCount)
+	}
+}
+
+func TestServerFrameRejection(t *testing.T) {
+	server, err := NewServer(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", frameTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.ProtocolId = frameTestProtocolId
+
+	client, err := net.DialUDP("udp", nil, server.ListenAddress.(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Failed to create the client socket.\n%v", err)
+	}
+	defer client.Close()
+	client.Write([]byte("some other application's traffic"))
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = server.Read()
+	if !errors.Is(err, ErrProtocolMismatch) {
+		t.Errorf("Expected a protocol mismatch but got: %v", err)
+	}
+	if server.GetStats().ProtocolMismatches != 1 || server.GetPeerCount() != 0 {
+		t.Errorf("Server should have counted the mismatch without making a peer.")
+	}
+}
@@ -0,0 +1,453 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+)
+
+// ConnectionState describes how far along the connection handshake a
+// Connection is.
+type ConnectionState uint8
+
+const (
+	// StateDisconnected is the state of a connection without a session.
+	StateDisconnected ConnectionState = iota
+
+	// StateConnecting means a connect request was sent and the client is
+	// waiting on a challenge from the remote side.
+	StateConnecting
+
+	// StateChallenged means the client has answered the challenge and is
+	// waiting on the remote side to accept or reject it.
+	StateChallenged
+
+	// StateConnected means the handshake completed successfully.
+	StateConnected
+
+	// StateRejected means the remote side refused the connection or the
+	// handshake timed out.
+	StateRejected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateChallenged:
+		return "challenged"
+	case StateConnected:
+		return "connected"
+	case StateRejected:
+		return "rejected"
+	}
+	return fmt.Sprintf("state(%d)", uint8(s))
+}
+
+// RejectReason is sent by the accepting side of a handshake to explain why a
+// connection was refused.
+type RejectReason uint8
+
+const (
+	// RejectDenied is a generic refusal.
+	RejectDenied RejectReason = iota + 1
+
+	// RejectServerFull means the remote side isn't taking more connections.
+	RejectServerFull
+
+	// RejectTimeout is never sent on the wire; it's passed to OnRejected when
+	// the handshake didn't complete within HandshakeTimeout.
+	RejectTimeout
+
+	// RejectKeyExchange means only one side asked for a key exchange or the
+	// remote side failed to prove it owns the PinnedServerKey.
+	RejectKeyExchange
+
+	// RejectVersion means there's no protocol version both sides accept;
+	// see ProtocolVersion and MinProtocolVersion.
+	RejectVersion
+
+	// RejectUser is the first reason code available for application use.
+	RejectUser RejectReason = 128
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectDenied:
+		return "denied"
+	case RejectServerFull:
+		return "server full"
+	case RejectTimeout:
+		return "timeout"
+	case RejectKeyExchange:
+		return "key exchange"
+	case RejectVersion:
+		return "incompatible version"
+	}
+	if r >= RejectUser {
+		return fmt.Sprintf("user(%d)", uint8(r-RejectUser))
+	}
+	return fmt.Sprintf("reason(%d)", uint8(r))
+}
+
+// ConnectionEvent is the callback type for connection level events.
+type ConnectionEvent func(c *Connection)
+
+// RejectEvent is the callback type used when a handshake is refused.
+type RejectEvent func(c *Connection, reason RejectReason)
+
+// ConnectRequestEvent is the callback type used to decide if a remote address
+// that has passed the handshake challenge should be accepted. The data
+// parameter is the payload the remote side passed to Connect().
+type ConnectRequestEvent func(c *Connection, remote net.Addr, data []byte) (accept bool, reason RejectReason)
+
+// ControlChannel is the packet channel reserved for the library's own control
+// messages, such as the connection handshake. Packets on this channel are
+// never delivered to the application.
+const ControlChannel uint8 = 0x7F
+
+// control message types; the first byte of a control packet's payload
+const (
+	ctrlConnectRequest uint8 = iota + 1
+	ctrlChallenge
+	ctrlChallengeResponse
+	ctrlAccept
+	ctrlReject
+	ctrlKeepAlive
+	ctrlDisconnect
+	ctrlFragment
+)
+
+// State returns the handshake state of the connection.
+func (c *Connection) State() ConnectionState {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.state
+}
+
+// Connect starts the handshake with the connection's RemoteAddress. The data
+// supplied is made available to the remote side's OnConnectRequest event.
+// Tick() must be called afterwards to process the replies and resend packets
+// as needed; OnConnected or OnRejected will be fired once the handshake finishes.
+func (c *Connection) Connect(data []byte) error {
+	c.mu.Lock()
+	defer c.unlock()
+	if isNilAddr(c.RemoteAddress) {
+		return fmt.Errorf("No remote address specified to connect to.")
+	}
+	if c.MinProtocolVersion > ProtocolVersion {
+		return fmt.Errorf("MinProtocolVersion %d is newer than ProtocolVersion %d.", c.MinProtocolVersion, ProtocolVersion)
+	}
+
+	err := c.startKeyExchange()
+	if err != nil {
+		return err
+	}
+	c.clientSalt = make([]byte, clientSaltSize)
+	if _, err = rand.Read(c.clientSalt); err != nil {
+		return fmt.Errorf("Failed to generate the key salt.\n%v", err)
+	}
+
+	c.connectData = make([]byte, len(data))
+	copy(c.connectData, data)
+	c.challenge = nil
+	c.setSession(0, 0)
+	c.state = StateConnecting
+	c.handshakeStart = c.now()
+
+	return c.sendHandshake()
+}
+
+// isSessionPacket returns true if the packet came from the peer that
+// completed the handshake with this connection.
+func (c *Connection) isSessionPacket(p *Packet) bool {
+	return c.state == StateConnected && sameAddr(p.RemoteAddress, c.RemoteAddress)
+}
+
+// sendHandshake sends the packet appropriate for the client's current
+// handshake state and resets the retry timer.
+func (c *Connection) sendHandshake() error {
+	var err error
+	switch c.state {
+	case StateConnecting:
+		// the request is padded to the size of the challenge since the
+		// remote side never answers with more than it received
+		body := make([]byte, cookieSize, cookieSize+offerSize)
+		body = c.appendOffer(body)
+		err = c.sendControl(ctrlConnectRequest, body, c.RemoteAddress)
+	case StateChallenged:
+		body := make([]byte, 0, len(c.challenge)+clientSaltSize+len(c.connectData)+kxPublicKeySize+64)
+		body = append(body, c.challenge...)
+		if c.version >= keySaltVersion {
+			body = append(body, c.clientSalt...)
+		}
+		body = c.appendKeyExchange(body)
+		body = append(body, c.connectData...)
+		err = c.sendControl(ctrlChallengeResponse, body, c.RemoteAddress)
+	default:
+		return nil
+	}
+	c.handshakeRetry = c.now().Add(c.HandshakeRetryInterval)
+	return err
+}
+
+// updateHandshake resends the client's handshake packets if they haven't
+// been answered in time and gives up after HandshakeTimeout.
+func (c *Connection) updateHandshake() error {
+	if c.state != StateConnecting && c.state != StateChallenged {
+		return nil
+	}
+
+	t := c.now()
+	if t.Sub(c.handshakeStart) >= c.HandshakeTimeout {
+		c.reject(RejectTimeout)
+		return nil
+	}
+	if t.Before(c.handshakeRetry) {
+		return nil
+	}
+	return c.sendHandshake()
+}
+
+// reject moves the connection into the rejected state and fires OnRejected.
+func (c *Connection) reject(reason RejectReason) {
+	c.state = StateRejected
+	c.connectData = nil
+	c.challenge = nil
+	c.kxKey = nil
+	if c.OnRejected != nil {
+		c.queueEvent(func() { c.OnRejected(c, reason) })
+	}
+}
+
+// sendControl sends a control message of type t with the body to the remote
+// address specified.
+func (c *Connection) sendControl(t uint8, body []byte, remote net.Addr) error {
+	// the control channel is never reliable, so nothing holds on to the
+	// packet once it's sent
+	p := acquirePacket()
+	p.Chan = ControlChannel
+	p.Payload = append(append(p.Payload[:0], t), body...)
+	p.PayloadSize = uint32(len(p.Payload))
+	defer ReleasePacket(p)
+	return c.sendPacket(p, true, remote)
+}
+
+// handleControl processes a packet received on the ControlChannel.
+func (c *Connection) handleControl(p *Packet) {
+	if p.PayloadSize < 1 {
+		return
+	}
+	body := p.Payload[1:p.PayloadSize]
+
+	switch p.Payload[0] {
+	case ctrlConnectRequest:
+		c.handleConnectRequest(p.RemoteAddress, body, int(p.PayloadSize))
+	case ctrlChallengeResponse:
+		c.handleChallengeResponse(p.RemoteAddress, body)
+	case ctrlChallenge:
+		// only the first challenge is answered so that both sides end up
+		// with the same cookie for the session's keys
+		if c.state == StateConnecting && sameAddr(p.RemoteAddress, c.RemoteAddress) {
+			c.handleChallenge(body)
+		}
+	case ctrlAccept:
+		if c.state == StateChallenged && sameAddr(p.RemoteAddress, c.RemoteAddress) {
+			if err := c.finishKeyExchange(body); err != nil {
+				c.reject(RejectKeyExchange)
+				return
+			}
+			if c.version >= keySaltVersion {
+				if err := c.setKeySalt(makeKeySalt(c.challenge, c.clientSalt)); err != nil {
+					c.reject(RejectKeyExchange)
+					return
+				}
+			}
+			c.state = StateConnected
+			c.connectData = nil
+			c.challenge = nil
+			if c.OnConnected != nil {
+				c.queueEvent(func() { c.OnConnected(c) })
+			}
+		}
+	case ctrlDisconnect:
+		if c.hasSession() && sameAddr(p.RemoteAddress, c.RemoteAddress) && len(body) > 0 {
+			c.handleDisconnect(DisconnectReason(body[0]))
+		}
+	case ctrlReject:
+		if (c.state == StateConnecting || c.state == StateChallenged) &&
+			sameAddr(p.RemoteAddress, c.RemoteAddress) && len(body) > 0 {
+			c.reject(RejectReason(body[0]))
+		}
+	}
+}
+
+// handleChallenge answers the challenge cookie in body, which is followed by
+// the version and features agreed on unless the remote side is from before
+// the version exchange.
+func (c *Connection) handleChallenge(body []byte) {
+	version, features := legacyVersion, Feature(0)
+	switch len(body) {
+	case cookieSize:
+	case cookieSize + agreementSize:
+		version, features = parseAgreement(body[cookieSize:])
+	default:
+		return
+	}
+	if !c.acceptsVersion(version) {
+		c.stats.IncompatibleVersions++
+		c.reject(RejectVersion)
+		return
+	}
+
+	c.challenge = make([]byte, len(body))
+	copy(c.challenge, body)
+	c.setSession(version, features&c.offeredFeatures())
+	c.state = StateChallenged
+	c.sendHandshake()
+}
+
+// handleConnectRequest answers a connect request of size bytes with a
+// challenge cookie that the remote address has to echo back to prove it can
+// receive packets there. Nothing is kept about the remote address until then,
+// so the version and features agreed on are echoed back along with it.
+func (c *Connection) handleConnectRequest(remote net.Addr, body []byte, size int) {
+	if c.state == StateConnected {
+		if sameAddr(remote, c.RemoteAddress) {
+			// our accept must have been lost, so send it again
+			c.sendControl(ctrlAccept, c.acceptBody, remote)
+		} else {
+			c.sendUnverified(ctrlReject, []byte{byte(RejectServerFull)}, remote, size)
+		}
+		return
+	}
+
+	version, minVersion, offered := legacyVersion, uint8(0), Feature(0)
+	hasOffer := len(body) >= cookieSize+offerSize
+	if hasOffer {
+		version, minVersion, offered = parseOffer(body[cookieSize:])
+	}
+	version, features, ok := c.agree(version, minVersion, offered)
+	if !ok {
+		c.stats.IncompatibleVersions++
+		c.sendUnverified(ctrlReject, []byte{byte(RejectVersion)}, remote, size)
+		return
+	}
+
+	var ext []byte
+	if hasOffer {
+		ext = appendAgreement(nil, version, features)
+	}
+	cookie, err := c.makeCookie(remote, ext)
+	if err != nil {
+		return
+	}
+	c.sendUnverified(ctrlChallenge, cookie, remote, size)
+}
+
+// handleChallengeResponse checks the cookie echoed back by the remote
+// address and, if it checks out, accepts or rejects the connection.
+func (c *Connection) handleChallengeResponse(remote net.Addr, body []byte) {
+	if c.state == StateConnected {
+		if sameAddr(remote, c.RemoteAddress) {
+			c.sendControl(ctrlAccept, c.acceptBody, remote)
+		}
+		return
+	}
+
+	cookie := body
+	ext, body, ok := c.openCookie(body, remote)
+	if !ok {
+		return
+	}
+	version, features := legacyVersion, Feature(0)
+	if ext != nil {
+		version, features = parseAgreement(ext)
+	}
+	var clientSalt []byte
+	if version >= keySaltVersion {
+		if len(body) < clientSaltSize {
+			return
+		}
+		clientSalt, body = body[:clientSaltSize], body[clientSaltSize:]
+	}
+	clientPub, serverAddr, data, ok := parseKeyExchange(body)
+	if !ok {
+		return
+	}
+
+	// both sides have to agree on using a key exchange
+	if c.KeyExchange != (clientPub != nil) {
+		c.sendControl(ctrlReject, []byte{byte(RejectKeyExchange)}, remote)
+		return
+	}
+
+	if c.OnConnectRequest != nil {
+		// the decision is needed right away, so the connection is unlocked
+		// around the event instead of queueing it
+		data = append([]byte(nil), data...)
+		c.mu.Unlock()
+		accept, reason := c.OnConnectRequest(c, remote, data)
+		c.mu.Lock()
+		if !accept {
+			c.sendControl(ctrlReject, []byte{byte(reason)}, remote)
+			return
+		}
+
+		// someone else may have connected while the connection was unlocked
+		if c.state == StateConnected {
+			return
+		}
+	}
+
+	c.acceptBody = []byte{0}
+	if clientPub != nil {
+		acceptBody, err := c.acceptKeyExchange(clientPub, serverAddr, remote)
+		if err != nil {
+			c.sendControl(ctrlReject, []byte{byte(RejectKeyExchange)}, remote)
+			return
+		}
+		c.acceptBody = acceptBody
+	}
+
+	if clientSalt != nil {
+		if err := c.setKeySalt(makeKeySalt(cookie, clientSalt)); err != nil {
+			c.sendControl(ctrlReject, []byte{byte(RejectKeyExchange)}, remote)
+			return
+		}
+	}
+	c.setSession(version, features&c.offeredFeatures())
+	c.RemoteAddress = remote
+	c.state = StateConnected
+	c.sendControl(ctrlAccept, c.acceptBody, remote)
+	if c.OnConnected != nil {
+		c.queueEvent(func() { c.OnConnected(c) })
+	}
+}
+
+// makeKeySalt returns the salt for a session's keys from the challenge
+// cookie the accepting side made and the connecting side's random salt.
+func makeKeySalt(cookie, clientSalt []byte) []byte {
+	salt := make([]byte, 0, cookieSize+clientSaltSize)
+	salt = append(salt, cookie[:cookieSize]...)
+	return append(salt, clientSalt...)
+}
+
+// sameAddr returns true if both addresses refer to the same place; UDP
+// addresses are compared by IP and port.
+func sameAddr(a, b net.Addr) bool {
+	if isNilAddr(a) || isNilAddr(b) {
+		return false
+	}
+	ua, ok := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if ok && ok2 {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
@@ -0,0 +1,205 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	handshakeTestPort = 42005
+)
+
+// tickUntil ticks both connections until done returns true or the timeout
+// is reached; it returns the result of done.
+func tickUntil(a, b *Connection, timeout time.Duration, done func() bool) bool {
+	endTime := time.Now().Add(timeout)
+	for time.Now().Before(endTime) {
+		a.Tick()
+		b.Tick()
+		if done() {
+			return true
+		}
+	}
+	return done()
+}
+
+func TestHandshakeAccept(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", handshakeTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+
+	var requestData string
+	serverConnected := false
+	server.OnConnectRequest = func(c *Connection, remote net.Addr, data []byte) (bool, RejectReason) {
+		requestData = string(data)
+		return true, 0
+	}
+	server.OnConnected = func(c *Connection) {
+		serverConnected = true
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", handshakeTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+
+	clientConnected := false
+	client.OnConnected = func(c *Connection) {
+		clientConnected = true
+	}
+
+	err = client.Connect([]byte("HELLO"))
+	if err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	if client.State() != StateConnecting {
+		t.Errorf("Client should be connecting but was %v.", client.State())
+	}
+
+	ok := tickUntil(server, client, time.Second*2, func() bool {
+		return serverConnected && clientConnected
+	})
+	if !ok {
+		t.Fatalf("Handshake did not complete (server: %v, client: %v).", server.State(), client.State())
+	}
+	if requestData != "HELLO" {
+		t.Errorf("Server got the wrong connect data: %q", requestData)
+	}
+	if client.State() != StateConnected || server.State() != StateConnected {
+		t.Errorf("Both sides should be connected (server: %v, client: %v).", server.State(), client.State())
+	}
+
+	// a connected client can send data to the server
+	testPayload := []byte("PING")
+	err = client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server failed to read the client's data.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != "PING" {
+		t.Errorf("Server read the wrong payload: %q", string(p.Payload[:p.PayloadSize]))
+	}
+}
+
+func TestHandshakeReject(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", handshakeTestPort+1), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+	server.OnConnectRequest = func(c *Connection, remote net.Addr, data []byte) (bool, RejectReason) {
+		return false, RejectUser + 1
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", handshakeTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+
+	var rejectReason RejectReason
+	client.OnRejected = func(c *Connection, reason RejectReason) {
+		rejectReason = reason
+	}
+	client.Connect(nil)
+
+	ok := tickUntil(server, client, time.Second*2, func() bool {
+		return client.State() == StateRejected
+	})
+	if !ok {
+		t.Fatalf("Client was not rejected (client: %v).", client.State())
+	}
+	if rejectReason != RejectUser+1 {
+		t.Errorf("Client got the wrong reject reason: %d", rejectReason)
+	}
+	if server.State() == StateConnected {
+		t.Errorf("Server should not be connected after rejecting the client.")
+	}
+}
+
+func TestHandshakeDropsStrangers(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", handshakeTestPort+2), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", handshakeTestPort+2))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+
+	// send data without doing the handshake first
+	testPayload := []byte("PING")
+	client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+
+	server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	p, err := server.Read()
+	if err == nil || p != nil {
+		t.Errorf("Server should not have read a packet from an unconnected client.")
+	}
+	if server.GetLastSeenSeq() != 0 {
+		t.Errorf("Server should not have updated acks for an unconnected client.")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", handshakeTestPort+3))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.HandshakeTimeout = time.Millisecond * 100
+
+	var rejectReason RejectReason
+	client.OnRejected = func(c *Connection, reason RejectReason) {
+		rejectReason = reason
+	}
+	client.Connect(nil)
+
+	endTime := time.Now().Add(time.Second)
+	for time.Now().Before(endTime) && client.State() != StateRejected {
+		client.Tick()
+	}
+	if rejectReason != RejectTimeout {
+		t.Errorf("Client should have timed out but got state %v, reason %d.", client.State(), rejectReason)
+	}
+}
+
+// TestHandshakeNilRemote checks that a nil *net.UDPAddr stored as the
+// RemoteAddress is treated as no remote address at all.
+func TestHandshakeNilRemote(t *testing.T) {
+	network := NewMemoryNetwork()
+	conn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	var remote *net.UDPAddr
+	c := NewTransportConnection(testServerBufferSize, conn, remote)
+	defer c.Close()
+	if err = c.Connect(nil); err == nil {
+		t.Errorf("Connect should fail without a remote address.")
+	}
+	c.mu.Lock()
+	hasSession := c.hasSession()
+	c.mu.Unlock()
+	if hasSession {
+		t.Errorf("A connection without a remote address shouldn't have a session.")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+// hasSession returns true if the connection has a remote side it's expected
+// to be talking to: either one that completed the handshake or, for
+// connections not using the handshake, just a remote address.
+func (c *Connection) hasSession() bool {
+	if isNilAddr(c.RemoteAddress) || !c.isOpen {
+		return false
+	}
+	return c.state == StateConnected || (c.state == StateDisconnected && !c.RequireHandshake)
+}
+
+// updateKeepAlive fires OnTimeout and closes the connection if nothing has
+// been received for IdleTimeout, otherwise it sends a keepalive packet if
+// nothing has been sent for KeepAliveInterval.
+func (c *Connection) updateKeepAlive() error {
+	if !c.hasSession() {
+		return nil
+	}
+
+	t := c.now()
+	if c.IdleTimeout > 0 && !c.lastRecvTime.IsZero() && t.Sub(c.lastRecvTime) >= c.IdleTimeout {
+		c.timeout()
+		return nil
+	}
+
+	if c.KeepAliveInterval > 0 && t.Sub(c.lastSendTime) >= c.KeepAliveInterval {
+		// keepalives are consumed by Read() on the other side, but they
+		// still carry this side's acks
+		return c.sendControl(ctrlKeepAlive, nil, c.RemoteAddress)
+	}
+
+	return nil
+}
+
+// timeout fires OnTimeout, lets the remote side know in case it's still
+// listening and then ends the session.
+func (c *Connection) timeout() {
+	if c.OnTimeout != nil {
+		c.queueEvent(func() { c.OnTimeout(c) })
+	}
+	c.sendDisconnect(DisconnectTimeout)
+	c.endSession()
+}
@@ -0,0 +1,160 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	keepAliveTestPort = 42015
+)
+
+// TestKeepAliveAcks makes sure a reliable packet gets acknowledged by the
+// keepalives of a server that never sends anything itself.
+func TestKeepAliveAcks(t *testing.T) {
+	server, err := NewServer(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", keepAliveTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.KeepAliveInterval = time.Millisecond * 20
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", keepAliveTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+
+	gotAcked := false
+	testPayload := []byte("PING")
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Second, 5)
+	rp.OnAck = func(c *Connection, rp *ReliablePacket) {
+		gotAcked = true
+	}
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+
+	endTime := time.Now().Add(time.Second)
+	for time.Now().Before(endTime) && !gotAcked {
+		server.Tick()
+		client.Tick()
+	}
+	if !gotAcked {
+		t.Errorf("The reliable packet was never acked by a keepalive.")
+	}
+	if client.GetAcksNeededLen() != 0 {
+		t.Errorf("Client should not be waiting on any acks but has %d.", client.GetAcksNeededLen())
+	}
+}
+
+// TestIdleTimeout makes sure a server peer times out once the client
+// stops sending anything and tells the client that it did.
+func TestIdleTimeout(t *testing.T) {
+	server, err := NewServer(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", keepAliveTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.IdleTimeout = time.Millisecond * 100
+	server.KeepAliveInterval = time.Millisecond * 20
+
+	left := false
+	server.OnPeerLeft = func(s *Server, peer *Connection) {
+		left = true
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", keepAliveTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+	client.KeepAliveInterval = time.Millisecond * 20
+
+	timedOut := false
+	client.IdleTimeout = time.Millisecond * 100
+	client.OnTimeout = func(c *Connection) {
+		timedOut = true
+	}
+
+	// while both sides send keepalives, neither should time out
+	testPayload := []byte("PING")
+	client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	endTime := time.Now().Add(time.Millisecond * 300)
+	for time.Now().Before(endTime) {
+		server.Tick()
+		client.Tick()
+	}
+	if left || server.GetPeerCount() != 1 {
+		t.Fatalf("Server dropped a client that was sending keepalives.")
+	}
+	if timedOut {
+		t.Fatalf("Client timed out even though the server never went quiet.")
+	}
+
+	// once the client goes quiet, the server should drop it and tell the
+	// client why; the client keeps reading so the disconnect isn't lost
+	// behind the server's keepalives
+	var reason DisconnectReason
+	client.OnDisconnected = func(c *Connection, r DisconnectReason) {
+		reason = r
+	}
+	client.KeepAliveInterval = 0
+	endTime = time.Now().Add(time.Second)
+	for time.Now().Before(endTime) && (!left || reason == 0) {
+		server.Tick()
+		client.Tick()
+	}
+	if !left || server.GetPeerCount() != 0 {
+		t.Errorf("Server never timed out the quiet client.")
+	}
+	if reason != DisconnectTimeout || client.IsOpen() {
+		t.Errorf("Client should have been disconnected for a timeout but got: %v", reason)
+	}
+	if timedOut {
+		t.Errorf("Client timed out instead of reading the server's disconnect.")
+	}
+}
+
+// TestCloneTimeout checks that a clone timing out leaves the Socket it
+// shares open for the connection it was cloned from.
+func TestCloneTimeout(t *testing.T) {
+	network := NewMemoryNetwork()
+	baseConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	nowhere := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	clock := NewManualClock(time.Now())
+	base := NewTransportConnection(testServerBufferSize, baseConn, nowhere)
+	defer base.Close()
+
+	clone := base.Clone(base.ListenAddress, nowhere)
+	clone.Clock = clock
+	clone.IdleTimeout = time.Minute
+	timedOut := false
+	clone.OnTimeout = func(c *Connection) {
+		timedOut = true
+	}
+	testPayload := []byte("PING")
+	err = clone.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil {
+		t.Fatalf("Clone failed to send data.\n%v", err)
+	}
+	clock.Advance(time.Minute)
+	clone.Tick()
+	if !timedOut || clone.IsOpen() {
+		t.Fatalf("Clone should have timed out and closed (timed out: %v).", timedOut)
+	}
+
+	err = base.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil || !base.IsOpen() {
+		t.Errorf("The clone's timeout closed the shared Socket.\n%v", err)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	// ErrKeyExchange is returned when the remote side's half of the key
+	// exchange is malformed or doesn't prove it owns the pinned server key.
+	ErrKeyExchange = errors.New("Key exchange failed.")
+)
+
+const (
+	kxPublicKeySize  = 32
+	kxSessionKeySize = 32
+
+	// the label used as the HKDF salt when deriving the session keys
+	kxLabel = "netpeddler session keys v1"
+)
+
+// GenerateStaticKey creates a new X25519 key suitable for StaticKey. The
+// public half can be handed out to clients to use as their PinnedServerKey.
+func GenerateStaticKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate the static key.\n%v", err)
+	}
+	return key, nil
+}
+
+// startKeyExchange creates the client's ephemeral key for a new handshake.
+func (c *Connection) startKeyExchange() error {
+	c.clearSessionKeys()
+	c.kxKey = nil
+	if !c.KeyExchange {
+		return nil
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to generate the key exchange key.\n%v", err)
+	}
+	c.kxKey = key
+	return nil
+}
+
+// appendKeyExchange appends the client's half of the key exchange to the
+// challenge response: a flag byte and, if the key exchange is on, the
+// ephemeral public key followed by the server address the client dialed.
+func (c *Connection) appendKeyExchange(body []byte) []byte {
+	if c.kxKey == nil {
+		return append(body, 0)
+	}
+	addr := c.RemoteAddress.String()
+	body = append(body, 1)
+	body = append(body, c.kxKey.PublicKey().Bytes()...)
+	body = append(body, byte(len(addr)))
+	return append(body, addr...)
+}
+
+// parseKeyExchange splits the client's half of the key exchange off the
+// front of the challenge response body. The public key is nil if the client
+// didn't ask for a key exchange.
+func parseKeyExchange(body []byte) (pub []byte, serverAddr string, rest []byte, ok bool) {
+	if len(body) < 1 {
+		return nil, "", nil, false
+	}
+	if body[0] == 0 {
+		return nil, "", body[1:], true
+	}
+
+	body = body[1:]
+	if len(body) < kxPublicKeySize+1 {
+		return nil, "", nil, false
+	}
+	pub = body[:kxPublicKeySize]
+	addrLen := int(body[kxPublicKeySize])
+	body = body[kxPublicKeySize+1:]
+	if len(body) < addrLen {
+		return nil, "", nil, false
+	}
+	return pub, string(body[:addrLen]), body[addrLen:], true
+}
+
+// acceptKeyExchange completes the accepting side of the key exchange with
+// the client's public key, sets the session keys and returns the body of the
+// accept message. The accept carries the ephemeral and static public keys
+// used along with a tag sealed with the new keys to prove they're shared.
+func (c *Connection) acceptKeyExchange(clientPub []byte, serverAddr string, remote net.Addr) ([]byte, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(clientPub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := ephemeral.ECDH(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	var staticPub []byte
+	if c.StaticKey != nil {
+		staticSecret, err := c.StaticKey.ECDH(peerKey)
+		if err != nil {
+			return nil, err
+		}
+		secret = append(secret, staticSecret...)
+		staticPub = c.StaticKey.PublicKey().Bytes()
+	}
+
+	clientAddr := remote.String()
+	info := kxInfo(clientPub, ephemeral.PublicKey().Bytes(), staticPub, clientAddr, serverAddr)
+	clientKey, serverKey := deriveSessionKeys(secret, info)
+	err = c.useKeys(serverKey, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	c.sessionKeys = true
+
+	body := []byte{1}
+	body = append(body, ephemeral.PublicKey().Bytes()...)
+	if staticPub != nil {
+		body = append(body, 1)
+		body = append(body, staticPub...)
+	} else {
+		body = append(body, 0)
+	}
+	body = append(body, byte(len(clientAddr)))
+	body = append(body, clientAddr...)
+
+	// the confirmation tag uses the zero nonce; packets use random ones
+	var counter [nonceCounterSize]byte
+	body = c.sendAEAD.Seal(body, makeNonce(c.sendAEAD, counter[:]), nil, info)
+	return body, nil
+}
+
+// finishKeyExchange completes the client's side of the key exchange with
+// the body of the accept message and sets the session keys.
+func (c *Connection) finishKeyExchange(body []byte) error {
+	if len(body) < 1 {
+		return ErrKeyExchange
+	}
+	if body[0] == 0 {
+		// the remote side isn't doing a key exchange
+		if c.kxKey != nil {
+			return ErrKeyExchange
+		}
+		return nil
+	}
+	if c.kxKey == nil {
+		// and here it's the other way around
+		return ErrKeyExchange
+	}
+
+	body = body[1:]
+	if len(body) < kxPublicKeySize+1 {
+		return ErrKeyExchange
+	}
+	ephemeralPub := body[:kxPublicKeySize]
+	hasStatic := body[kxPublicKeySize] != 0
+	body = body[kxPublicKeySize+1:]
+
+	var staticPub []byte
+	if hasStatic {
+		if len(body) < kxPublicKeySize {
+			return ErrKeyExchange
+		}
+		staticPub = body[:kxPublicKeySize]
+		body = body[kxPublicKeySize:]
+	}
+	if c.PinnedServerKey != nil && !hmac.Equal(staticPub, c.PinnedServerKey.Bytes()) {
+		return ErrKeyExchange
+	}
+
+	if len(body) < 1 || len(body) < int(body[0])+1 {
+		return ErrKeyExchange
+	}
+	clientAddr := string(body[1 : 1+int(body[0])])
+	tag := body[1+int(body[0]):]
+
+	ephemeralKey, err := ecdh.X25519().NewPublicKey(ephemeralPub)
+	if err != nil {
+		return ErrKeyExchange
+	}
+	secret, err := c.kxKey.ECDH(ephemeralKey)
+	if err != nil {
+		return ErrKeyExchange
+	}
+	if staticPub != nil {
+		staticKey, err := ecdh.X25519().NewPublicKey(staticPub)
+		if err != nil {
+			return ErrKeyExchange
+		}
+		staticSecret, err := c.kxKey.ECDH(staticKey)
+		if err != nil {
+			return ErrKeyExchange
+		}
+		secret = append(secret, staticSecret...)
+	}
+
+	info := kxInfo(c.kxKey.PublicKey().Bytes(), ephemeralPub, staticPub, clientAddr, c.RemoteAddress.String())
+	clientKey, serverKey := deriveSessionKeys(secret, info)
+	recvAEAD, err := newAEAD(serverKey)
+	if err != nil {
+		return err
+	}
+	var counter [nonceCounterSize]byte
+	_, err = recvAEAD.Open(nil, makeNonce(recvAEAD, counter[:]), tag, info)
+	if err != nil {
+		return ErrKeyExchange
+	}
+
+	err = c.useKeys(clientKey, serverKey)
+	if err != nil {
+		return err
+	}
+	c.sessionKeys = true
+	c.kxKey = nil
+	return nil
+}
+
+// clearSessionKeys removes the encryption keys set by a key exchange or
+// derived for the session and goes back to the keys set by the application,
+// if any.
+func (c *Connection) clearSessionKeys() {
+	if c.sessionKeys || c.keySalt != nil {
+		c.sessionKeys = false
+		c.keySalt = nil
+		c.useAEADs(c.appSendAEAD, c.appRecvAEAD)
+	}
+	c.acceptBody = nil
+}
+
+// kxInfo binds the session keys to the public keys exchanged and to both
+// addresses as each side sees them.
+func kxInfo(clientPub, ephemeralPub, staticPub []byte, clientAddr, serverAddr string) []byte {
+	info := make([]byte, 0, 3*kxPublicKeySize+len(clientAddr)+len(serverAddr)+1)
+	info = append(info, clientPub...)
+	info = append(info, ephemeralPub...)
+	info = append(info, staticPub...)
+	info = append(info, clientAddr...)
+	info = append(info, 0)
+	return append(info, serverAddr...)
+}
+
+// deriveSessionKeys runs HKDF with SHA-256 over the shared secret to get
+// the key used for each direction.
+func deriveSessionKeys(secret, info []byte) (clientKey, serverKey []byte) {
+	extract := hmac.New(sha256.New, []byte(kxLabel))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+
+	var okm, t []byte
+	for i := byte(1); len(okm) < 2*kxSessionKeySize; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(t)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		t = expand.Sum(nil)
+		okm = append(okm, t...)
+	}
+	return okm[:kxSessionKeySize], okm[kxSessionKeySize : 2*kxSessionKeySize]
+}
+
+// isHandshakePacket returns true for the control messages that make up the
+// handshake. With KeyExchange on, these are sent in the clear since the
+// keys only exist once the handshake is done.
+func isHandshakePacket(p *Packet) bool {
+	if p.Chan != ControlChannel || p.PayloadSize < 1 {
+		return false
+	}
+	switch p.Payload[0] {
+	case ctrlConnectRequest, ctrlChallenge, ctrlChallengeResponse, ctrlAccept, ctrlReject:
+		return true
+	}
+	return false
+}
+
+// handleClearHandshake processes a datagram that failed to decrypt if it's
+// a handshake message, which is sent in the clear with KeyExchange and is
+// sealed with the application's keys rather than the session's otherwise.
+// Returns true if it was handled.
+func (c *Connection) handleClearHandshake(b []byte, addr net.Addr) bool {
+	if !c.KeyExchange {
+		if c.keySalt == nil || c.appRecvAEAD == nil {
+			return false
+		}
+		plain, err := decrypt(c.appRecvAEAD, b)
+		if err != nil {
+			return false
+		}
+		c.remoteLegacySeal = sealedLegacy(b)
+		b = plain
+	}
+	p, err := DecodePacket(b, c.MaxPayloadSize)
+	if err != nil || !isHandshakePacket(p) {
+		return false
+	}
+	p.RemoteAddress = addr
+	c.handleControl(p)
+	ReleasePacket(p)
+	return true
+}
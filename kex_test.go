@@ -0,0 +1,155 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	kexTestPort = 42060
+)
+
+func kexTestSetup(t *testing.T, port int) (*Connection, *Connection) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", port), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	server.RequireHandshake = true
+	server.KeyExchange = true
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		server.Close()
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	client.KeyExchange = true
+
+	return server, client
+}
+
+func TestKeyExchange(t *testing.T) {
+	server, client := kexTestSetup(t, kexTestPort)
+	defer server.Close()
+	defer client.Close()
+
+	staticKey, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server.StaticKey = staticKey
+	client.PinnedServerKey = staticKey.PublicKey()
+
+	err = client.Connect([]byte("HELLO"))
+	if err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	ok := tickUntil(server, client, time.Second*2, func() bool {
+		return server.State() == StateConnected && client.State() == StateConnected
+	})
+	if !ok {
+		t.Fatalf("Handshake did not complete (server: %v, client: %v).", server.State(), client.State())
+	}
+	if !server.IsEncrypted() || !client.IsEncrypted() {
+		t.Fatalf("Both sides should have session keys after the handshake.")
+	}
+
+	// data is encrypted with the keys from the exchange
+	testPayload := []byte("SECRET PING")
+	err = client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	if bytes.Contains(client.frameBuffer, testPayload) {
+		t.Errorf("The payload was sent in plaintext.")
+	}
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := server.Read()
+	for err == nil && p.Chan == ControlChannel {
+		p, err = server.Read()
+	}
+	if err != nil {
+		t.Fatalf("Server failed to read the encrypted packet.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != string(testPayload) {
+		t.Errorf("Server read the wrong payload: %q", string(p.Payload[:p.PayloadSize]))
+	}
+
+	pong := []byte("SECRET PONG")
+	err = server.Send(NewPacket(0, 0, 0, 0, 0, uint32(len(pong)), pong), true, nil)
+	if err != nil {
+		t.Fatalf("Server failed to send data.\n%v", err)
+	}
+	client.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err = client.Read()
+	if err != nil {
+		t.Fatalf("Client failed to read the encrypted reply.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != string(pong) {
+		t.Errorf("Client read the wrong payload: %q", string(p.Payload[:p.PayloadSize]))
+	}
+
+	// the session keys go away with the session
+	client.Disconnect(DisconnectShutdown)
+	tickUntil(server, server, time.Second, func() bool {
+		return server.State() == StateDisconnected
+	})
+	if server.IsEncrypted() {
+		t.Errorf("Server kept the session keys after the client disconnected.")
+	}
+}
+
+func TestKeyExchangePinnedKey(t *testing.T) {
+	server, client := kexTestSetup(t, kexTestPort+1)
+	defer server.Close()
+	defer client.Close()
+
+	staticKey, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	otherKey, err := GenerateStaticKey()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	server.StaticKey = otherKey
+	client.PinnedServerKey = staticKey.PublicKey()
+
+	var gotReason RejectReason
+	client.OnRejected = func(c *Connection, reason RejectReason) {
+		gotReason = reason
+	}
+	client.Connect(nil)
+	tickUntil(server, client, time.Second*2, func() bool {
+		return client.State() == StateRejected
+	})
+	if client.State() != StateRejected || gotReason != RejectKeyExchange {
+		t.Errorf("Client should reject a server with the wrong key (%v, %d).", client.State(), gotReason)
+	}
+	if client.IsEncrypted() {
+		t.Errorf("Client should not have keys after a failed key exchange.")
+	}
+}
+
+func TestKeyExchangeMismatch(t *testing.T) {
+	server, client := kexTestSetup(t, kexTestPort+2)
+	defer server.Close()
+	defer client.Close()
+	client.KeyExchange = false
+
+	var gotReason RejectReason
+	client.OnRejected = func(c *Connection, reason RejectReason) {
+		gotReason = reason
+	}
+	client.Connect(nil)
+	tickUntil(server, client, time.Second*2, func() bool {
+		return client.State() == StateRejected
+	})
+	if gotReason != RejectKeyExchange {
+		t.Errorf("Server should refuse a client without a key exchange (%v, %d).", client.State(), gotReason)
+	}
+}
@@ -6,8 +6,10 @@ package netpeddler
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -17,10 +19,10 @@ import (
 type SendablePacket interface {
 	// Send the packet on `c` Connection, possibly generating a new sequence number,
 	// to the remote address specified.
-	Send(c *Connection, generateNewSeq bool, remote *net.UDPAddr) error
+	Send(c *Connection, generateNewSeq bool, remote net.Addr) error
 
 	// SetRemoteAddress will set the remote address property of the packet.
-	SetRemoteAddress(remote *net.UDPAddr)
+	SetRemoteAddress(remote net.Addr)
 }
 
 type PacketEvent func(c *Connection, rp *ReliablePacket)
@@ -33,10 +35,17 @@ type ReliablePacket struct {
 	RetryCount    uint8
 	nextCheck     time.Time
 	failCount     uint8
+	sentTime      time.Time
+	fragments     *fragmentAcks
+
+	// done is closed once the packet is acked or fails, with acked
+	// recording which; both are used by WaitForAck()
+	done  chan struct{}
+	acked bool
 }
 
 type Packet struct {
-	RemoteAddress *net.UDPAddr
+	RemoteAddress net.Addr
 	ClientId      uint32
 	Seq           uint32
 	Chan          uint8
@@ -44,19 +53,64 @@ type Packet struct {
 	AckMask       uint32
 	PayloadSize   uint32
 	Payload       []byte
+
+	// MsgId identifies a message within its channel for the channels that
+	// need one, such as sequenced and reliable channels. Unlike Seq, it stays
+	// the same when a ReliablePacket is resent.
+	MsgId    uint32
+	hasMsgId bool
 }
 
 var (
-	byteOrder     = binary.BigEndian
-	payloadOffset = binary.Size(uint32(1))*5 + binary.Size(uint8(1))
+	// ErrTruncatedHeader is returned when a datagram is too short to hold
+	// a packet header.
+	ErrTruncatedHeader = errors.New("Packet header is truncated.")
+
+	// ErrPayloadSizeMismatch is returned when the PayloadSize in a packet's
+	// header doesn't match the number of bytes that follow the header.
+	ErrPayloadSizeMismatch = errors.New("Packet payload size doesn't match the bytes read.")
+
+	// ErrPayloadTooLarge is returned when a packet's payload is larger than
+	// the maximum payload size allowed.
+	ErrPayloadTooLarge = errors.New("Packet payload is too large.")
+)
+
+var (
+	byteOrder = binary.BigEndian
+
+	// packetPool holds released packets for NewPacket() and Read() to reuse
+	packetPool = sync.Pool{
+		New: func() interface{} { return new(Packet) },
+	}
 )
 
 const (
+	// payloadOffset is the size of the header: ClientId, Seq, Chan, AckSeq,
+	// AckMask and PayloadSize
+	payloadOffset = 4*5 + 1
+
+	// payloads bigger than this aren't kept around when a packet is released
+	maxPooledPayload = 64 * 1024
+
 	ackMaskDepth = 32
+
+	// chanMsgIdFlag is set in the channel byte on the wire when a MsgId
+	// precedes the payload.
+	chanMsgIdFlag = 0x80
+	msgIdSize     = 4
 )
 
+// seqGreaterThan returns true if s1 comes after s2, allowing for the sequence
+// numbers to wrap around. This is the serial number arithmetic of RFC 1982:
+// s1 is greater if it's less than half of the sequence space ahead of s2.
+func seqGreaterThan(s1, s2 uint32) bool {
+	return (s1 > s2 && s1-s2 < 1<<31) || (s1 < s2 && s2-s1 > 1<<31)
+}
+
+// NewPacket creates a packet with a copy of the first size bytes of b as its
+// payload. Packets released with ReleasePacket() are reused when possible.
 func NewPacket(id uint32, seq uint32, ch uint8, ack uint32, m uint32, size uint32, b []byte) *Packet {
-	p := new(Packet)
+	p := acquirePacket()
 	p.ClientId = id
 	p.Seq = seq
 	p.Chan = ch
@@ -64,88 +118,161 @@ func NewPacket(id uint32, seq uint32, ch uint8, ack uint32, m uint32, size uint3
 	p.AckMask = m
 
 	p.PayloadSize = size
-	p.Payload = make([]byte, size)
-	copy(p.Payload, b)
+	p.Payload = resizeBytes(p.Payload, int(size))
+	n := copy(p.Payload, b)
+	clear(p.Payload[n:])
 
 	return p
 }
 
-func (p *Packet) WriteTo(b *bytes.Buffer) error {
-	b.Reset()
+// ReleasePacket hands a packet that's no longer needed back so that its
+// memory can be reused by NewPacket() and Read(). Neither the packet nor
+// its Payload may be used once it has been released; a ReliablePacket
+// shouldn't be released until it has been acked or has failed.
+func ReleasePacket(p *Packet) {
+	if p == nil {
+		return
+	}
+	payload := p.Payload[:0]
+	if cap(payload) > maxPooledPayload {
+		payload = nil
+	}
+	*p = Packet{Payload: payload}
+	packetPool.Put(p)
+}
 
-	// client id
-	err := binary.Write(b, byteOrder, p.ClientId)
-	if err != nil {
-		return fmt.Errorf("Error while writing the client id from packet to buffer.\n%v", err)
+// acquirePacket returns an empty packet from the pool.
+func acquirePacket() *Packet {
+	return packetPool.Get().(*Packet)
+}
+
+// resizeBytes returns a slice of n bytes, reusing b if it's big enough.
+func resizeBytes(b []byte, n int) []byte {
+	if cap(b) < n {
+		return make([]byte, n)
 	}
+	return b[:n]
+}
 
-	// sequence
-	err = binary.Write(b, byteOrder, p.Seq)
+// WriteTo encodes the packet into the buffer, replacing what was in it.
+func (p *Packet) WriteTo(b *bytes.Buffer) error {
+	b.Reset()
+	encoded, err := p.AppendBinary(b.AvailableBuffer())
 	if err != nil {
-		return fmt.Errorf("Error while writing the sequence from packet to buffer.\n%v", err)
+		return err
 	}
+	b.Write(encoded)
+	return nil
+}
 
-	// channel
-	err = binary.Write(b, byteOrder, p.Chan)
-	if err != nil {
-		return fmt.Errorf("Error while writing the channel from packet to buffer.\n%v", err)
+// AppendBinary appends the encoded packet to b and returns the extended
+// slice. Nothing is allocated if b has room for the packet.
+func (p *Packet) AppendBinary(b []byte) ([]byte, error) {
+	if p.PayloadSize > uint32(len(p.Payload)) {
+		return b, fmt.Errorf("Packet payload size %d is larger than its %d byte payload.", p.PayloadSize, len(p.Payload))
 	}
 
-	// ack sequence
-	err = binary.Write(b, byteOrder, p.AckSeq)
-	if err != nil {
-		return fmt.Errorf("Error while writing the ACK sequence from packet to buffer.\n%v", err)
+	ch := p.Chan
+	size := p.PayloadSize
+	headerSize := payloadOffset
+	if p.hasMsgId {
+		ch |= chanMsgIdFlag
+		size += msgIdSize
+		headerSize += msgIdSize
 	}
 
-	// ack mask
-	err = binary.Write(b, byteOrder, p.AckMask)
-	if err != nil {
-		return fmt.Errorf("Error while writing the ACK bitmask from packet to buffer.\n%v", err)
+	var header [payloadOffset + msgIdSize]byte
+	byteOrder.PutUint32(header[0:], p.ClientId)
+	byteOrder.PutUint32(header[4:], p.Seq)
+	header[8] = ch
+	byteOrder.PutUint32(header[9:], p.AckSeq)
+	byteOrder.PutUint32(header[13:], p.AckMask)
+	byteOrder.PutUint32(header[17:], size)
+	if p.hasMsgId {
+		byteOrder.PutUint32(header[payloadOffset:], p.MsgId)
 	}
 
-	// payload size
-	err = binary.Write(b, byteOrder, p.PayloadSize)
-	if err != nil {
-		return fmt.Errorf("Error while writing the payload size from packet to buffer.\n%v", err)
+	b = append(b, header[:headerSize]...)
+	return append(b, p.Payload[:p.PayloadSize]...), nil
+}
+
+// MarshalBinary returns the encoded packet.
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	return p.AppendBinary(nil)
+}
+
+// UnmarshalBinary decodes the encoded bytes b into the packet, reusing its
+// Payload if there's room. The packet's RemoteAddress is left alone. See
+// DecodePacket() for the checks made.
+func (p *Packet) UnmarshalBinary(b []byte) error {
+	return p.decode(b, 0)
+}
+
+// NewPacketFrom builds a packet from the first n bytes of b, which were
+// read from the network. See DecodePacket() for the checks made.
+func NewPacketFrom(n int, b []byte) (*Packet, error) {
+	if n < 0 || n > len(b) {
+		return nil, fmt.Errorf("%w: %d bytes were read but the buffer only holds %d.", ErrTruncatedHeader, n, len(b))
 	}
+	return DecodePacket(b[:n], 0)
+}
 
-	// payload
-	err = binary.Write(b, byteOrder, p.Payload[:p.PayloadSize])
+// DecodePacket builds a packet from the encoded bytes b. The header has to
+// be complete, the PayloadSize it claims has to match the bytes that follow
+// it and, if maxPayloadSize isn't zero, it can't be larger than that.
+// Failures wrap ErrTruncatedHeader, ErrPayloadSizeMismatch or
+// ErrPayloadTooLarge.
+func DecodePacket(b []byte, maxPayloadSize int) (*Packet, error) {
+	p := acquirePacket()
+	err := p.decode(b, maxPayloadSize)
 	if err != nil {
-		return fmt.Errorf("Error while writing the payload from packet to buffer.\n%v", err)
+		ReleasePacket(p)
+		return nil, err
 	}
-
-	return nil
+	return p, nil
 }
 
-func NewPacketFrom(n int, b []byte) (*Packet, error) {
+// decode reads the encoded bytes b into the packet.
+func (p *Packet) decode(b []byte, maxPayloadSize int) error {
 	// make sure we at least have enough bytes for the packet 'header'
-	if n < payloadOffset {
-		return nil, fmt.Errorf("Not enough bytes (%d) read to form a packet.", n)
+	if len(b) < payloadOffset {
+		return fmt.Errorf("%w: %d bytes is less than the %d byte header.", ErrTruncatedHeader, len(b), payloadOffset)
 	}
 
-	p := new(Packet)
-	buf := bytes.NewBuffer(b)
-
 	// read in the packet 'header' information
-	binary.Read(buf, byteOrder, &p.ClientId)
-	binary.Read(buf, byteOrder, &p.Seq)
-	binary.Read(buf, byteOrder, &p.Chan)
-	binary.Read(buf, byteOrder, &p.AckSeq)
-	binary.Read(buf, byteOrder, &p.AckMask)
-	binary.Read(buf, byteOrder, &p.PayloadSize)
+	p.ClientId = byteOrder.Uint32(b[0:])
+	p.Seq = byteOrder.Uint32(b[4:])
+	p.Chan = b[8]
+	p.AckSeq = byteOrder.Uint32(b[9:])
+	p.AckMask = byteOrder.Uint32(b[13:])
+	p.PayloadSize = byteOrder.Uint32(b[17:])
+	p.MsgId = 0
+	p.hasMsgId = false
+
+	// pull the message id off the front of the payload if there is one
+	offset := payloadOffset
+	if p.Chan&chanMsgIdFlag != 0 {
+		if len(b) < offset+msgIdSize || p.PayloadSize < msgIdSize {
+			return fmt.Errorf("%w: %d bytes is too short for a header with a message id.", ErrTruncatedHeader, len(b))
+		}
+		p.MsgId = byteOrder.Uint32(b[offset:])
+		p.hasMsgId = true
+		p.Chan &^= chanMsgIdFlag
+		p.PayloadSize -= msgIdSize
+		offset += msgIdSize
+	}
 
-	// resize if necessary
-	byteLength := n + 1
-	if cap(p.Payload) <= byteLength-payloadOffset {
-		//fmt.Printf("\nPACKET: adjusting payload size from %d to %d.\n", cap(p.Payload), byteLength)
-		p.Payload = make([]byte, byteLength)
+	if uint64(p.PayloadSize) != uint64(len(b)-offset) {
+		return fmt.Errorf("%w: the header claims %d bytes but %d follow it.", ErrPayloadSizeMismatch, p.PayloadSize, len(b)-offset)
+	}
+	if maxPayloadSize > 0 && p.PayloadSize > uint32(maxPayloadSize) {
+		return fmt.Errorf("%w: %d bytes is over the maximum of %d.", ErrPayloadTooLarge, p.PayloadSize, maxPayloadSize)
 	}
 
 	// copy the payload slice
-	copy(p.Payload, b[payloadOffset:])
+	p.Payload = append(p.Payload[:0], b[offset:]...)
 
-	return p, nil
+	return nil
 }
 
 func (p *Packet) MakeReliable(retryInterval time.Duration, retryCount uint8) *ReliablePacket {
@@ -155,14 +282,13 @@ func (p *Packet) MakeReliable(retryInterval time.Duration, retryCount uint8) *Re
 	rp.RetryCount = retryCount
 	rp.OnAck = nil
 	rp.OnFailToAck = nil
-	rp.nextCheck = time.Now().Add(retryInterval)
 	rp.failCount = 0
 	return rp
 }
 
 func (p *Packet) IsAckBy(ackPacket *Packet) bool {
 	// if ack packet's seq is below the packets, then it can't possibly ack it
-	if ackPacket.AckSeq < p.Seq {
+	if seqGreaterThan(p.Seq, ackPacket.AckSeq) {
 		return false
 	}
 
@@ -182,33 +308,38 @@ func (p *Packet) IsAckBy(ackPacket *Packet) bool {
 }
 
 // Send sends a non-reliable packet on the connection specified.
-func (p *Packet) Send(c *Connection, generateNewSeq bool, remote *net.UDPAddr) error {
+func (p *Packet) Send(c *Connection, generateNewSeq bool, remote net.Addr) error {
 	ra := remote
-	if ra == nil {
+	if isNilAddr(ra) {
 		ra = p.RemoteAddress
 	}
 	return c.Send(p, generateNewSeq, ra)
 }
 
 // Send sends a reliable packet on the connection specified.
-func (rp *ReliablePacket) Send(c *Connection, generateNewSeq bool, remote *net.UDPAddr) error {
+func (rp *ReliablePacket) Send(c *Connection, generateNewSeq bool, remote net.Addr) error {
 	ra := remote
-	if ra == nil {
+	if isNilAddr(ra) {
 		ra = rp.RemoteAddress
 	}
-	if ra == nil {
+	if isNilAddr(ra) {
 		ra = rp.Packet.RemoteAddress
 	}
 	return c.SendReliable(rp, generateNewSeq, ra)
 }
 
+// HasMsgId returns true if the packet carries a MsgId.
+func (p *Packet) HasMsgId() bool {
+	return p.hasMsgId
+}
+
 // SetRemoteAddress will set the remote address property of the packet.
-func (p *Packet) SetRemoteAddress(remote *net.UDPAddr) {
+func (p *Packet) SetRemoteAddress(remote net.Addr) {
 	p.RemoteAddress = remote
 }
 
 // SetRemoteAddress will set the remote address property of the packet.
-func (rp *ReliablePacket) SetRemoteAddress(remote *net.UDPAddr) {
+func (rp *ReliablePacket) SetRemoteAddress(remote net.Addr) {
 	rp.Packet.RemoteAddress = remote
 	rp.RemoteAddress = remote
 }
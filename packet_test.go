@@ -0,0 +1,162 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// encodePacket returns the encoded bytes of a packet with the payload and,
+// if msgId isn't zero, that message id.
+func encodePacket(t testing.TB, ch uint8, msgId uint32, payload []byte) []byte {
+	p := NewPacket(42, 7, ch, 6, 0x15, uint32(len(payload)), payload)
+	if msgId != 0 {
+		p.MsgId = msgId
+		p.hasMsgId = true
+	}
+	var buf bytes.Buffer
+	if err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("Failed to encode the packet.\n%v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodePacketErrors(t *testing.T) {
+	good := encodePacket(t, 1, 0, []byte("PING"))
+	withMsgId := encodePacket(t, 1, 99, []byte("PING"))
+
+	// a header claiming a 4GB payload
+	huge := append([]byte(nil), good...)
+	byteOrder.PutUint32(huge[payloadOffset-4:], 0xFFFFFFFF)
+
+	tests := []struct {
+		name       string
+		b          []byte
+		maxPayload int
+		err        error
+	}{
+		{"empty", nil, 0, ErrTruncatedHeader},
+		{"short header", good[:payloadOffset-1], 0, ErrTruncatedHeader},
+		{"missing message id", withMsgId[:payloadOffset+2], 0, ErrTruncatedHeader},
+		{"short payload", good[:len(good)-1], 0, ErrPayloadSizeMismatch},
+		{"trailing bytes", append(append([]byte(nil), good...), 0), 0, ErrPayloadSizeMismatch},
+		{"huge payload size", huge, 0, ErrPayloadSizeMismatch},
+		{"over the maximum", good, 3, ErrPayloadTooLarge},
+		{"at the maximum", good, 4, nil},
+		{"with message id", withMsgId, 0, nil},
+	}
+	for _, test := range tests {
+		p, err := DecodePacket(test.b, test.maxPayload)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected error %v but got %v.", test.name, test.err, err)
+		}
+		if err == nil && string(p.Payload[:p.PayloadSize]) != "PING" {
+			t.Errorf("%s: decoded payload %q instead of PING.", test.name, p.Payload[:p.PayloadSize])
+		}
+	}
+
+	// n has to fit in the buffer
+	if _, err := NewPacketFrom(len(good)+1, good); !errors.Is(err, ErrTruncatedHeader) {
+		t.Errorf("Reading past the end of the buffer should fail but returned: %v", err)
+	}
+}
+
+// TestMarshalBinary checks that MarshalBinary() matches WriteTo() and that
+// UnmarshalBinary() reuses the packet's payload.
+func TestMarshalBinary(t *testing.T) {
+	encoded := encodePacket(t, 1, 99, []byte("PING"))
+	p, err := DecodePacket(encoded, 0)
+	if err != nil {
+		t.Fatalf("Failed to decode the packet.\n%v", err)
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to marshal the packet.\n%v", err)
+	}
+	if !bytes.Equal(b, encoded) {
+		t.Errorf("MarshalBinary encoded %x instead of %x.", b, encoded)
+	}
+
+	payload := p.Payload
+	if err := p.UnmarshalBinary(encodePacket(t, 2, 0, []byte("PONG"))); err != nil {
+		t.Fatalf("Failed to unmarshal the packet.\n%v", err)
+	}
+	if p.Chan != 2 || p.hasMsgId || string(p.Payload) != "PONG" {
+		t.Errorf("Unmarshaled the wrong packet: %+v.", p)
+	}
+	if &p.Payload[0] != &payload[0] {
+		t.Errorf("UnmarshalBinary should have reused the payload.")
+	}
+
+	p.PayloadSize = 5
+	if _, err := p.MarshalBinary(); err == nil {
+		t.Errorf("Marshaling a PayloadSize larger than the payload should fail.")
+	}
+	ReleasePacket(p)
+}
+
+// FuzzNewPacketFrom checks that no datagram makes the decoder panic and
+// that whatever it accepts encodes back to the same bytes.
+func FuzzNewPacketFrom(f *testing.F) {
+	f.Add(encodePacket(f, 0, 0, nil))
+	f.Add(encodePacket(f, 1, 0, []byte("PING")))
+	f.Add(encodePacket(f, ControlChannel, 1234, []byte{ctrlKeepAlive}))
+	f.Add([]byte{0, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, err := NewPacketFrom(len(b), b)
+		if err != nil {
+			if !errors.Is(err, ErrTruncatedHeader) && !errors.Is(err, ErrPayloadSizeMismatch) {
+				t.Fatalf("Decoding failed with an unexpected error: %v", err)
+			}
+			return
+		}
+		if int(p.PayloadSize) > len(p.Payload) {
+			t.Fatalf("PayloadSize %d is larger than the %d byte payload.", p.PayloadSize, len(p.Payload))
+		}
+
+		var buf bytes.Buffer
+		if err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("Failed to encode the decoded packet.\n%v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), b) {
+			t.Fatalf("Packet encoded to %x instead of %x.", buf.Bytes(), b)
+		}
+	})
+}
+
+// FuzzPacketRoundTrip checks that every packet WriteTo() encodes decodes
+// back to the same packet.
+func FuzzPacketRoundTrip(f *testing.F) {
+	f.Add(uint32(42), uint32(1), uint8(0), uint32(0), uint32(0), uint32(0), []byte("PING"))
+	f.Add(uint32(0), uint32(0xFFFFFFFF), uint8(ControlChannel), uint32(7), uint32(0x80000001), uint32(99), []byte{})
+
+	f.Fuzz(func(t *testing.T, clientId, seq uint32, ch uint8, ackSeq, ackMask, msgId uint32, payload []byte) {
+		ch &= ControlChannel
+		p := NewPacket(clientId, seq, ch, ackSeq, ackMask, uint32(len(payload)), payload)
+		if msgId != 0 {
+			p.MsgId = msgId
+			p.hasMsgId = true
+		}
+
+		var buf bytes.Buffer
+		if err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("Failed to encode the packet.\n%v", err)
+		}
+		p2, err := NewPacketFrom(buf.Len(), buf.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to decode the packet.\n%v", err)
+		}
+
+		if p2.ClientId != clientId || p2.Seq != seq || p2.Chan != ch || p2.AckSeq != ackSeq ||
+			p2.AckMask != ackMask || p2.MsgId != p.MsgId || p2.hasMsgId != p.hasMsgId {
+			t.Fatalf("Packet header changed from %+v to %+v.", p, p2)
+		}
+		if !bytes.Equal(p2.Payload[:p2.PayloadSize], payload) {
+			t.Fatalf("Payload changed from %x to %x.", payload, p2.Payload[:p2.PayloadSize])
+		}
+	})
+}
@@ -0,0 +1,215 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitAction is what a RateLimiter does with a remote address that
+// goes over its limits. Datagrams over the limit are always dropped.
+type RateLimitAction uint8
+
+const (
+	// RateLimitDrop only drops the datagrams over the limit.
+	RateLimitDrop RateLimitAction = iota
+
+	// RateLimitNotify also fires OnLimited when an address goes over the limit.
+	RateLimitNotify
+
+	// RateLimitBan also fires OnLimited and bans the address's IP on the
+	// Banlist for BanDuration.
+	RateLimitBan
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitNotify:
+		return "notify"
+	case RateLimitBan:
+		return "ban"
+	}
+	return fmt.Sprintf("action(%d)", uint8(a))
+}
+
+// RateLimitEvent is the callback type used when a remote address goes over
+// the limits of a RateLimiter.
+type RateLimitEvent func(r *RateLimiter, addr net.Addr)
+
+// RateLimiter keeps a token bucket per remote address for both the number
+// of datagrams and the number of bytes read. Each bucket refills at its
+// rate per second up to its burst size. A RateLimiter is safe for concurrent
+// use, but its settings should be in place before it's used.
+type RateLimiter struct {
+	// PacketsPerSecond and BytesPerSecond are the sustained rates allowed
+	// per remote address. A zero value doesn't limit that rate.
+	PacketsPerSecond float64
+	BytesPerSecond   float64
+
+	// PacketBurst and ByteBurst are the most that can be read at once after
+	// an address has been quiet. ByteBurst should be at least the largest
+	// datagram expected. Zero values default to one second at the rate, but
+	// never less than one packet or one datagram of defaultBufferSize bytes.
+	PacketBurst float64
+	ByteBurst   float64
+
+	// Action is what happens when an address goes over the limit.
+	Action RateLimitAction
+
+	// OnLimited is called when an address goes over the limit with the
+	// RateLimitNotify or RateLimitBan actions. It's called once each time the
+	// address goes over the limit, not for every datagram dropped.
+	OnLimited RateLimitEvent
+
+	// Banlist and BanDuration are used by the RateLimitBan action. The
+	// Banlist should also be the Filter of the Connection or Server.
+	Banlist     *Banlist
+	BanDuration time.Duration
+
+	// Clock, if set, is used in place of the real time to refill the buckets.
+	Clock Clock
+
+	buckets   map[string]*rateBucket
+	lastPrune time.Time
+	dropped   uint64
+	mu        sync.Mutex
+}
+
+type rateBucket struct {
+	packets float64
+	bytes   float64
+	updated time.Time
+	limited bool
+}
+
+const (
+	// how often buckets that have refilled are thrown away
+	ratePruneInterval = time.Second * 10
+)
+
+// NewRateLimiter creates a RateLimiter that drops datagrams over the rates
+// supplied; either rate may be zero to leave it unlimited.
+func NewRateLimiter(packetsPerSecond, bytesPerSecond float64) *RateLimiter {
+	r := new(RateLimiter)
+	r.PacketsPerSecond = packetsPerSecond
+	r.BytesPerSecond = bytesPerSecond
+	r.buckets = make(map[string]*rateBucket)
+	return r
+}
+
+// Allow takes a datagram of size bytes from the bucket for the address and
+// returns false if it's over the limit, taking the configured Action.
+func (r *RateLimiter) Allow(addr net.Addr, size int) bool {
+	r.mu.Lock()
+	allowed, limited := r.take(addr, size)
+	r.mu.Unlock()
+
+	if limited {
+		r.limited(addr)
+	}
+	return allowed
+}
+
+// GetDropped returns the number of datagrams dropped for being over the limit.
+func (r *RateLimiter) GetDropped() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+// take removes a datagram of size bytes from the bucket for the address.
+// The limited flag is true if the address just went over the limit.
+func (r *RateLimiter) take(addr net.Addr, size int) (allowed bool, limited bool) {
+	if r.buckets == nil {
+		r.buckets = make(map[string]*rateBucket)
+	}
+
+	t := clockNow(r.Clock)
+	if t.Sub(r.lastPrune) >= ratePruneInterval {
+		r.prune(t)
+	}
+
+	key := addr.String()
+	b := r.buckets[key]
+	if b == nil {
+		b = &rateBucket{packets: r.packetBurst(), bytes: r.byteBurst(), updated: t}
+		r.buckets[key] = b
+	}
+
+	// refill the bucket for the time since it was last used
+	elapsed := t.Sub(b.updated).Seconds()
+	b.updated = t
+	b.packets = refill(b.packets, elapsed, r.PacketsPerSecond, r.packetBurst())
+	b.bytes = refill(b.bytes, elapsed, r.BytesPerSecond, r.byteBurst())
+
+	overPackets := r.PacketsPerSecond > 0 && b.packets < 1
+	overBytes := r.BytesPerSecond > 0 && b.bytes < float64(size)
+	if !overPackets && !overBytes {
+		b.packets--
+		b.bytes -= float64(size)
+		b.limited = false
+		return true, false
+	}
+
+	r.dropped++
+	limited = !b.limited
+	b.limited = true
+	return false, limited
+}
+
+// limited takes the configured action for an address that just went over
+// the limit.
+func (r *RateLimiter) limited(addr net.Addr) {
+	if r.Action == RateLimitDrop {
+		return
+	}
+	if ip := addrIP(addr); r.Action == RateLimitBan && r.Banlist != nil && ip != nil {
+		r.Banlist.Ban(ip.String(), r.BanDuration)
+	}
+	if r.OnLimited != nil {
+		r.OnLimited(r, addr)
+	}
+}
+
+func (r *RateLimiter) packetBurst() float64 {
+	if r.PacketBurst > 0 {
+		return r.PacketBurst
+	}
+	return math.Max(r.PacketsPerSecond, 1)
+}
+
+func (r *RateLimiter) byteBurst() float64 {
+	if r.ByteBurst > 0 {
+		return r.ByteBurst
+	}
+	return math.Max(r.BytesPerSecond, defaultBufferSize)
+}
+
+// refill adds the tokens earned over the elapsed seconds, up to the burst size.
+func refill(tokens, elapsed, rate, burst float64) float64 {
+	tokens += elapsed * rate
+	if tokens > burst {
+		tokens = burst
+	}
+	return tokens
+}
+
+// prune throws away the buckets that haven't been used for long enough to
+// refill completely, since a new bucket starts out full anyway.
+func (r *RateLimiter) prune(t time.Time) {
+	r.lastPrune = t
+	for key, b := range r.buckets {
+		elapsed := t.Sub(b.updated).Seconds()
+		if (r.PacketsPerSecond <= 0 || refill(b.packets, elapsed, r.PacketsPerSecond, r.packetBurst()) >= r.packetBurst()) &&
+			(r.BytesPerSecond <= 0 || refill(b.bytes, elapsed, r.BytesPerSecond, r.byteBurst()) >= r.byteBurst()) {
+			delete(r.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	rateLimitTestPort = 42070
+)
+
+func TestRateLimiterBuckets(t *testing.T) {
+	r := NewRateLimiter(100, 1000)
+	r.PacketBurst = 5
+	r.ByteBurst = 1000
+	a := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+	for i := 0; i < 5; i++ {
+		if !r.Allow(a, 10) {
+			t.Fatalf("Packet %d should fit in the burst.", i)
+		}
+	}
+	if r.Allow(a, 10) {
+		t.Errorf("The packet after the burst should be over the limit.")
+	}
+	if !r.Allow(b, 10) {
+		t.Errorf("Another address shouldn't share the bucket.")
+	}
+
+	// the byte limit applies on its own as well
+	if r.Allow(b, 1000) {
+		t.Errorf("A datagram bigger than the bytes left should be over the limit.")
+	}
+
+	// and the buckets refill over time
+	time.Sleep(time.Millisecond * 30)
+	if !r.Allow(a, 10) {
+		t.Errorf("The bucket didn't refill.")
+	}
+	if r.GetDropped() != 2 {
+		t.Errorf("Expected 2 drops but counted %d.", r.GetDropped())
+	}
+}
+
+// TestRateLimiterSlowRates checks that the default bursts still let a
+// datagram through when the rates are below one packet or one datagram a
+// second.
+func TestRateLimiterSlowRates(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	r := NewRateLimiter(0.5, 100)
+	r.Clock = clock
+	a := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+	if !r.Allow(a, 1000) {
+		t.Fatalf("The first datagram should fit in the default burst.")
+	}
+	if r.Allow(a, 10) {
+		t.Errorf("A second packet straight away should be over the limit.")
+	}
+
+	// two seconds earns the next packet, but the bytes take ten
+	clock.Advance(time.Second * 2)
+	if r.Allow(a, 1000) {
+		t.Errorf("The bytes shouldn't have refilled after two seconds.")
+	}
+	clock.Advance(time.Second * 8)
+	if !r.Allow(a, 1000) {
+		t.Errorf("The bucket didn't refill.")
+	}
+}
+
+func TestRateLimitBan(t *testing.T) {
+	server, err := NewConnection(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", rateLimitTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+
+	bl := NewBanlist()
+	server.Filter = bl
+	server.RateLimit = NewRateLimiter(1, 0)
+	server.RateLimit.PacketBurst = 5
+	server.RateLimit.Action = RateLimitBan
+	server.RateLimit.Banlist = bl
+	server.RateLimit.BanDuration = time.Minute
+	limitedCount := 0
+	server.RateLimit.OnLimited = func(r *RateLimiter, addr net.Addr) {
+		limitedCount++
+	}
+
+	client, err := NewConnection(serverTestBufferSize, "", fmt.Sprintf("127.0.0.1:%d", rateLimitTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+
+	// flood the server; only the burst should get through
+	const floodCount = 20
+	testPayload := []byte("FLOOD")
+	for i := 0; i < floodCount; i++ {
+		client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	}
+
+	readCount := 0
+	for {
+		server.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		if _, err := server.Read(); err != nil {
+			break
+		}
+		readCount++
+	}
+	if readCount != 5 {
+		t.Errorf("Server should have read the burst of 5 packets but read %d.", readCount)
+	}
+	if limitedCount != 1 {
+		t.Errorf("OnLimited should fire once but fired %d times.", limitedCount)
+	}
+	stats := server.GetStats()
+	if stats.RateLimited != 1 || stats.FilteredDropped != floodCount-6 {
+		t.Errorf("Expected 1 packet rate limited and %d filtered but got %d and %d.",
+			floodCount-6, stats.RateLimited, stats.FilteredDropped)
+	}
+	if !bl.IsBanned(net.ParseIP("127.0.0.1")) {
+		t.Errorf("The flooding address should be banned.")
+	}
+}
+
+// acceptFunc is an AddressFilter that calls a function.
+type acceptFunc func(addr net.Addr) bool
+
+func (f acceptFunc) Accept(addr net.Addr) bool {
+	return f(addr)
+}
+
+// TestRateLimitReentrant checks that a Filter and an OnLimited callback can
+// call back into the Server or Connection that's reading without deadlocking.
+func TestRateLimitReentrant(t *testing.T) {
+	network := NewMemoryNetwork()
+	serverConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	server, err := NewTransportServer(serverTestBufferSize, serverConn)
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	listenerConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	listener := NewTransportConnection(serverTestBufferSize, listenerConn, nil)
+
+	limitedCount := 0
+	server.Filter = acceptFunc(func(addr net.Addr) bool {
+		server.GetStats()
+		return true
+	})
+	server.RateLimit = NewRateLimiter(1, 0)
+	server.RateLimit.Action = RateLimitNotify
+	server.RateLimit.OnLimited = func(r *RateLimiter, addr net.Addr) {
+		server.GetPeerCount()
+		limitedCount++
+	}
+	listener.Filter = acceptFunc(func(addr net.Addr) bool {
+		listener.GetStats()
+		return true
+	})
+	listener.RateLimit = NewRateLimiter(1, 0)
+	listener.RateLimit.Action = RateLimitNotify
+	listener.RateLimit.OnLimited = func(r *RateLimiter, addr net.Addr) {
+		listener.GetStats()
+		limitedCount++
+	}
+
+	// one client floods each side; nothing is closed with defer since a
+	// deadlocked Close would hang the test instead of failing it
+	var clients []*Connection
+	testPayload := []byte("FLOOD")
+	for _, remote := range []net.Addr{serverConn.LocalAddr(), listenerConn.LocalAddr()} {
+		clientConn, err := network.Listen("")
+		if err != nil {
+			t.Fatalf("Failed to listen on the memory network.\n%v", err)
+		}
+		client := NewTransportConnection(testServerBufferSize, clientConn, remote)
+		clients = append(clients, client)
+		for i := 0; i < 3; i++ {
+			if err := client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil); err != nil {
+				t.Fatalf("Client failed to send data.\n%v", err)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.ReadTimeout = time.Millisecond * 10
+		listener.ReadTimeout = time.Millisecond * 10
+		for i := 0; i < 5; i++ {
+			server.Tick()
+			listener.Tick()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Reading deadlocked when the callbacks used the Server or Connection.")
+	}
+	server.Close()
+	listener.Close()
+	for _, client := range clients {
+		client.Close()
+	}
+
+	if limitedCount != 2 {
+		t.Errorf("OnLimited should fire once for each side but fired %d times.", limitedCount)
+	}
+	if server.GetStats().RateLimited != 2 || listener.GetStats().RateLimited != 2 {
+		t.Errorf("Expected 2 packets rate limited on each side but got %d and %d.",
+			server.GetStats().RateLimited, listener.GetStats().RateLimited)
+	}
+}
@@ -5,13 +5,14 @@ package netpeddler
 
 import (
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var (
 	retryTestPort  = 42004
-	retryTestCount = 0
+	retryTestCount int32
 	retrySpeed     = time.Millisecond * 100
 )
 
@@ -24,6 +25,9 @@ func retryServer(t *testing.T, ch chan int) {
 	}
 	defer npConn.Close()
 
+	// this test counts every resent copy, so don't drop them as duplicates
+	npConn.DropDuplicates = false
+
 	// let the test know we're ready
 	ch <- serverReady
 
@@ -38,9 +42,9 @@ func retryServer(t *testing.T, ch chan int) {
 
 		// We got the packet
 		t.Logf("Server got packet: %v\n", string(p.Payload[:p.PayloadSize]))
-		t.Logf("Listener's last seq: %d ; ack mask: %x", npConn.lastSeenSeq, npConn.lastAckMask)
+		t.Logf("Listener's last seq: %d ; ack mask: %x", npConn.GetLastSeenSeq(), npConn.GetAckMask())
 
-		retryTestCount++
+		atomic.AddInt32(&retryTestCount, 1)
 	}
 }
 
@@ -71,9 +75,10 @@ func retryClient(t *testing.T, ch chan int) {
 		npConn.Tick()
 		if time.Now().After(endTime) {
 			// we should have our retry count now
-			if retryCount != retryTestCount-1 { //-1 for the first packet sent
+			count := atomic.LoadInt32(&retryTestCount)
+			if retryCount != count-1 { //-1 for the first packet sent
 				ch <- clientSendFail
-				t.Errorf("Client failed to retry packets enough (%d).\n", retryTestCount)
+				t.Errorf("Client failed to retry packets enough (%d).\n", count)
 				return
 			} else {
 				break
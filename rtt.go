@@ -0,0 +1,106 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	defaultMinRetryTimeout = time.Millisecond * 10
+	defaultMaxRetryTimeout = time.Second * 3
+
+	// the clock granularity used in the retransmission timeout calculation
+	rttGranularity = time.Millisecond
+)
+
+// GetRTT returns the smoothed round-trip time measured from acknowledged
+// ReliablePackets, or 0 if nothing has been measured yet.
+func (c *Connection) GetRTT() time.Duration {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.srtt
+}
+
+// GetRTTVariance returns the smoothed variation of the round-trip time
+// measurements, or 0 if nothing has been measured yet.
+func (c *Connection) GetRTTVariance() time.Duration {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.rttvar
+}
+
+// GetRetryTimeout returns the retransmission timeout derived from the
+// round-trip time estimate, or 0 if nothing has been measured yet.
+func (c *Connection) GetRetryTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.retryTimeout()
+}
+
+func (c *Connection) retryTimeout() time.Duration {
+	if !c.hasRTT {
+		return 0
+	}
+
+	variance := 4 * c.rttvar
+	if variance < rttGranularity {
+		variance = rttGranularity
+	}
+	return c.clampRetryTimeout(c.srtt + variance)
+}
+
+// updateRTT adds a round-trip time sample to the estimate using the
+// Jacobson/Karels algorithm from RFC 6298.
+func (c *Connection) updateRTT(sample time.Duration) {
+	if sample < 0 {
+		return
+	}
+
+	if !c.hasRTT {
+		c.srtt = sample
+		c.rttvar = sample / 2
+		c.hasRTT = true
+		return
+	}
+
+	diff := c.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	c.rttvar = (3*c.rttvar + diff) / 4
+	c.srtt = (7*c.srtt + sample) / 8
+}
+
+// retryInterval returns how long to wait for the ack of the reliable packet
+// before resending it. With AdaptiveRetry set and a round-trip time measured,
+// this is the retransmission timeout doubled for every failed attempt;
+// otherwise it's the packet's RetryInterval.
+func (c *Connection) retryInterval(rp *ReliablePacket) time.Duration {
+	rto := c.retryTimeout()
+	if !c.AdaptiveRetry || rto == 0 {
+		return rp.RetryInterval
+	}
+
+	// without a MaxRetryTimeout the doubling only stops short of overflowing
+	for i := uint8(0); i < rp.failCount && rto <= math.MaxInt64/2; i++ {
+		if c.MaxRetryTimeout > 0 && rto >= c.MaxRetryTimeout {
+			break
+		}
+		rto *= 2
+	}
+	return c.clampRetryTimeout(rto)
+}
+
+// clampRetryTimeout keeps the timeout within MinRetryTimeout and MaxRetryTimeout.
+func (c *Connection) clampRetryTimeout(rto time.Duration) time.Duration {
+	if rto < c.MinRetryTimeout {
+		return c.MinRetryTimeout
+	}
+	if c.MaxRetryTimeout > 0 && rto > c.MaxRetryTimeout {
+		return c.MaxRetryTimeout
+	}
+	return rto
+}
@@ -0,0 +1,140 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	rttTestPort = 42040
+)
+
+func TestRTTEstimate(t *testing.T) {
+	c := New(0)
+	if c.GetRTT() != 0 || c.GetRetryTimeout() != 0 {
+		t.Fatalf("A new connection shouldn't have an RTT estimate.")
+	}
+
+	// the first sample sets the estimate directly
+	c.updateRTT(time.Millisecond * 100)
+	if c.GetRTT() != time.Millisecond*100 || c.GetRTTVariance() != time.Millisecond*50 {
+		t.Errorf("First sample gave rtt %v, variance %v.", c.GetRTT(), c.GetRTTVariance())
+	}
+	if c.GetRetryTimeout() != time.Millisecond*300 {
+		t.Errorf("First sample gave a retry timeout of %v.", c.GetRetryTimeout())
+	}
+
+	// later samples are smoothed
+	c.updateRTT(time.Millisecond * 20)
+	if c.GetRTT() != time.Millisecond*90 || c.GetRTTVariance() != time.Millisecond*57+time.Millisecond/2 {
+		t.Errorf("Second sample gave rtt %v, variance %v.", c.GetRTT(), c.GetRTTVariance())
+	}
+
+	// steady samples shrink the variance
+	for i := 0; i < 100; i++ {
+		c.updateRTT(time.Millisecond * 20)
+	}
+	if c.GetRTT() > time.Millisecond*21 || c.GetRTTVariance() > time.Millisecond {
+		t.Errorf("Steady samples gave rtt %v, variance %v.", c.GetRTT(), c.GetRTTVariance())
+	}
+}
+
+func TestAdaptiveRetryInterval(t *testing.T) {
+	c := New(0)
+	rp := NewPacket(42, 0, 0, 0, 0, 0, nil).MakeReliable(time.Second, 10)
+
+	// without an estimate or adaptive mode the packet's interval is used
+	if c.retryInterval(rp) != time.Second {
+		t.Errorf("Expected the packet's retry interval but got %v.", c.retryInterval(rp))
+	}
+	c.AdaptiveRetry = true
+	if c.retryInterval(rp) != time.Second {
+		t.Errorf("Expected the packet's retry interval before any RTT sample but got %v.", c.retryInterval(rp))
+	}
+
+	// rto = 100ms + 4 * 50ms
+	c.updateRTT(time.Millisecond * 100)
+	expected := []time.Duration{300, 600, 1200, 2400, 3000, 3000}
+	for i, e := range expected {
+		rp.failCount = uint8(i)
+		if c.retryInterval(rp) != e*time.Millisecond {
+			t.Errorf("Retry %d should wait %v but got %v.", i, e*time.Millisecond, c.retryInterval(rp))
+		}
+	}
+
+	// without a maximum the backoff keeps doubling without overflowing
+	c.MaxRetryTimeout = 0
+	rp.failCount = 5
+	if c.retryInterval(rp) != time.Millisecond*9600 {
+		t.Errorf("Retry 5 should wait %v without a maximum but got %v.", time.Millisecond*9600, c.retryInterval(rp))
+	}
+	rp.failCount = 255
+	if c.retryInterval(rp) <= 0 {
+		t.Errorf("Retry interval overflowed to %v.", c.retryInterval(rp))
+	}
+
+	// tiny round trips are held to the minimum
+	c = New(0)
+	c.AdaptiveRetry = true
+	c.updateRTT(time.Microsecond)
+	rp.failCount = 0
+	if c.retryInterval(rp) != c.MinRetryTimeout {
+		t.Errorf("Retry interval should be held at %v but was %v.", c.MinRetryTimeout, c.retryInterval(rp))
+	}
+}
+
+func TestRTTMeasurement(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", rttTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", rttTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.AdaptiveRetry = true
+
+	const delay = time.Millisecond * 20
+	for i := 0; i < 3; i++ {
+		testPayload := []byte("PING")
+		rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Second, 5)
+		err = client.SendReliable(rp, true, nil)
+		if err != nil {
+			t.Fatalf("Client failed to send data.\n%v", err)
+		}
+
+		server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+		p, err := server.Read()
+		if err != nil {
+			t.Fatalf("Server failed to read data.\n%v", err)
+		}
+
+		// hold on to the ping for a bit so the round trip is measurable
+		time.Sleep(delay)
+		testPayload = []byte("PONG")
+		server.Send(NewPacket(0, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, p.RemoteAddress)
+
+		client.Socket.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read()
+		if err != nil {
+			t.Fatalf("Client failed to read data.\n%v", err)
+		}
+	}
+
+	if client.GetAcksNeededLen() != 0 {
+		t.Fatalf("Client still has %d packets waiting for acks.", client.GetAcksNeededLen())
+	}
+	if client.GetRTT() < delay || client.GetRTT() > time.Second {
+		t.Errorf("Client measured an unexpected RTT of %v.", client.GetRTT())
+	}
+	if client.GetRetryTimeout() < client.GetRTT() {
+		t.Errorf("Client's retry timeout %v is less than its RTT %v.", client.GetRetryTimeout(), client.GetRTT())
+	}
+}
@@ -0,0 +1,138 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var (
+	sequenceTestPort = 42035
+)
+
+func TestSeqGreaterThan(t *testing.T) {
+	tests := []struct {
+		s1, s2  uint32
+		greater bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{5, 5, false},
+		{0, 0xFFFFFFFF, true},
+		{3, 0xFFFFFFF0, true},
+		{0xFFFFFFF0, 3, false},
+		{0x7FFFFFFF, 0, true},
+		{0x80000001, 0, false},
+	}
+	for _, test := range tests {
+		if seqGreaterThan(test.s1, test.s2) != test.greater {
+			t.Errorf("seqGreaterThan(%x, %x) should be %v.", test.s1, test.s2, test.greater)
+		}
+	}
+}
+
+func TestAckCalculationsWrap(t *testing.T) {
+	//     lss | curmask | cur | expmask | expseq
+	// a new seq across the wrap; 0 is skipped so 0xFFFFFFFF -> 1 is a jump of 2
+	doAckTest(t, 0xFFFFFFFF, 0x0001, 1, 0x0005, 1)
+	doAckTest(t, 0xFFFFFFFE, 0x0003, 2, 0x0031, 2)
+
+	// an old seq from before the wrap comes in
+	doAckTest(t, 2, 0x0031, 0xFFFFFFFF, 0x0039, 2)
+
+	// a seq from before the wrap shouldn't look new to one just after it
+	doAckTest(t, 1, 0x0001, 0xFFFFFFF0, 0x20001, 1)
+	doAckTest(t, 1, 0x0001, 0xFFFFFF00, 0x0001, 1)
+}
+
+func TestIsAckByWrap(t *testing.T) {
+	p := NewPacket(42, 0xFFFFFFFE, 0, 0, 0, 0, nil)
+
+	ack := NewPacket(42, 0, 0, 2, 0x0031, 0, nil)
+	if !p.IsAckBy(ack) {
+		t.Errorf("Packet %x should be acked by %x with mask %x.", p.Seq, ack.AckSeq, ack.AckMask)
+	}
+
+	ack = NewPacket(42, 0, 0, 0xFFFFFFFD, 0xFFFFFFFF, 0, nil)
+	if p.IsAckBy(ack) {
+		t.Errorf("Packet %x should not be acked by the older %x.", p.Seq, ack.AckSeq)
+	}
+}
+
+func TestGetNextSeqWrap(t *testing.T) {
+	c := New(0)
+	c.nextSeq = 0xFFFFFFFF
+	if seq := c.GetNextSeq(); seq != 0xFFFFFFFF {
+		t.Errorf("Expected seq %x but got %x.", uint32(0xFFFFFFFF), seq)
+	}
+	if seq := c.GetNextSeq(); seq != 1 {
+		t.Errorf("Seq 0 should be skipped when wrapping but got %x.", seq)
+	}
+}
+
+// TestSequenceWrapConnection pings reliable packets across the sequence wrap
+// and makes sure every one of them gets acked.
+func TestSequenceWrapConnection(t *testing.T) {
+	server, err := NewConnection(testServerBufferSize, fmt.Sprintf("127.0.0.1:%d", sequenceTestPort), "")
+	if err != nil {
+		t.Fatalf("Failed to create the server connection.\n%v", err)
+	}
+	defer server.Close()
+	server.nextSeq = 0xFFFFFFF8
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", sequenceTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the client connection.\n%v", err)
+	}
+	defer client.Close()
+	client.nextSeq = 0xFFFFFFF0
+	client.SetChannelMode(1, ReliableOrdered)
+	server.SetChannelMode(1, ReliableOrdered)
+	client.getChannel(1).nextMsgId = 0xFFFFFFF0
+	server.getChannel(1).expectedMsgId = 0xFFFFFFF0
+
+	const pingCount = 32
+	acked := 0
+	for i := 0; i < pingCount; i++ {
+		testPayload := []byte(fmt.Sprintf("PING%d", i))
+		rp := NewPacket(42, 0, 1, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Second, 5)
+		rp.OnAck = func(c *Connection, rp *ReliablePacket) {
+			acked++
+		}
+		err = client.SendReliable(rp, true, nil)
+		if err != nil {
+			t.Fatalf("Client failed to send data.\n%v", err)
+		}
+
+		server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+		p, err := server.Read()
+		if err != nil {
+			t.Fatalf("Server failed to read ping %d.\n%v", i, err)
+		}
+		if string(p.Payload[:p.PayloadSize]) != string(testPayload) {
+			t.Fatalf("Server read %q but expected %q.", string(p.Payload[:p.PayloadSize]), string(testPayload))
+		}
+
+		testPayload = []byte("PONG")
+		err = server.Send(NewPacket(0, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, p.RemoteAddress)
+		if err != nil {
+			t.Fatalf("Server failed to send data.\n%v", err)
+		}
+
+		client.Socket.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read()
+		if err != nil {
+			t.Fatalf("Client failed to read pong %d.\n%v", i, err)
+		}
+	}
+
+	if acked != pingCount || client.GetAcksNeededLen() != 0 {
+		t.Errorf("Only %d of %d pings were acked; %d still waiting.", acked, pingCount, client.GetAcksNeededLen())
+	}
+	if client.GetLastSeenSeq() >= 0xFFFFFFF8 || server.GetLastSeenSeq() >= 0xFFFFFFF0 {
+		t.Errorf("Sequences didn't wrap (client saw %x, server saw %x).", client.GetLastSeenSeq(), server.GetLastSeenSeq())
+	}
+}
@@ -0,0 +1,520 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"context"
+	"crypto/ecdh"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// PeerEvent is the callback type for events about a Server's peers.
+type PeerEvent func(s *Server, peer *Connection)
+
+// ServerReadEvent is the callback type used when a Server reads a packet
+// from one of its peers.
+type ServerReadEvent func(s *Server, peer *Connection, p *Packet)
+
+// Server owns a single Socket, normally a UDP one, and demultiplexes the
+// packets read on it into one Connection per remote address. Each peer
+// Connection keeps its own sequence and ack state and sends from the Server's
+// Socket, which keeps the 1:* relationship of Clone() without routing packets
+// by hand.
+type Server struct {
+	Socket        net.PacketConn
+	ListenAddress net.Addr
+
+	// ProtocolId and UseChecksum are checked on every datagram before it
+	// reaches a peer and are passed along to each peer Connection.
+	ProtocolId  uint32
+	UseChecksum bool
+
+	// RequireHandshake indicates if peers have to complete the connection
+	// handshake before their packets are read. Peers only join the server
+	// once the handshake is done, and no peer Connection is even created for
+	// an address until it has echoed back its handshake cookie.
+	RequireHandshake bool
+
+	// OnConnectRequest is passed along to each peer Connection to decide
+	// if a handshake should be accepted.
+	OnConnectRequest ConnectRequestEvent
+
+	// KeepAliveInterval and IdleTimeout are passed along to each peer
+	// Connection; a peer that times out is removed from the server.
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+
+	// KeyExchange and StaticKey are passed along to each peer Connection so
+	// that every session gets its own encryption keys.
+	KeyExchange bool
+	StaticKey   *ecdh.PrivateKey
+
+	// AdaptiveRetry and ReliableFragments are passed along to each peer Connection.
+	AdaptiveRetry     bool
+	ReliableFragments bool
+
+	// OnDisconnected is passed along to each peer Connection and is called
+	// when a peer ends its session with Disconnect().
+	OnDisconnected DisconnectEvent
+
+	// OnPeerCreated is called when a Connection is made for a new remote
+	// address, before its first packet is processed. It's the place to set
+	// up per peer settings such as encryption keys. With RequireHandshake,
+	// the connect request comes before the peer exists, so use KeyExchange
+	// rather than keys set here.
+	OnPeerCreated PeerEvent
+
+	// OnPeerJoined is called when a new peer is first seen or, if
+	// RequireHandshake is set, when it completes the handshake.
+	OnPeerJoined PeerEvent
+
+	// OnPeerLeft is called when a joined peer is removed from the server.
+	OnPeerLeft PeerEvent
+
+	// OnPacketRead is called when a packet is successfully read from a peer.
+	OnPacketRead ServerReadEvent
+
+	// Filter, if set, is checked for every datagram before it reaches a
+	// peer, so refused addresses never get a peer Connection.
+	Filter AddressFilter
+
+	// RateLimit, if set, is checked for every datagram the Filter lets
+	// through, before it reaches a peer.
+	RateLimit *RateLimiter
+
+	// ReadTimeout is the read deadline used in Tick().
+	ReadTimeout time.Duration
+
+	// UpdateInterval is how often a Server running in the background with
+	// Start() updates its peers.
+	UpdateInterval time.Duration
+
+	// MaxPayloadSize is passed along to each peer Connection.
+	MaxPayloadSize int
+
+	// CompactHeaders is passed along to each peer Connection so that
+	// clients offering the compact header get it.
+	CompactHeaders bool
+
+	// MinProtocolVersion and Features are passed along to each peer
+	// Connection.
+	MinProtocolVersion uint8
+	Features           Feature
+
+	// Clock is passed along to each peer Connection.
+	Clock Clock
+
+	buffer       []byte
+	stats        ConnectionStats
+	peers        map[string]*Connection
+	lobby        *Connection
+	cookieKey    []byte
+	channelModes map[uint8]DeliveryMode
+	isOpen       bool
+
+	// stopBackground stops the goroutines started by Start()
+	stopBackground context.CancelFunc
+
+	// mu guards the peers and the server's other state while readMu
+	// guards the read buffer; peers are locked on their own
+	mu     sync.Mutex
+	readMu sync.Mutex
+}
+
+// NewServer creates a new Server listening on the local address supplied.
+// If no localAddress is specified, "127.0.0.1:0" is used.
+func NewServer(bufferSize uint32, localAddress string) (*Server, error) {
+	localAddressOpt := localAddress
+	if localAddressOpt == "" {
+		localAddressOpt = "127.0.0.1:0"
+	}
+	addr, err := net.ResolveUDPAddr("udp", localAddressOpt)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve the address to listen on: %s\n%v", localAddressOpt, err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on the address: %s\n%v", localAddressOpt, err)
+	}
+	if bufferSize > 0 {
+		conn.SetReadBuffer(int(bufferSize))
+		conn.SetWriteBuffer(int(bufferSize))
+	}
+
+	s, err := NewTransportServer(bufferSize, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the Server's Socket. Peers are dropped without firing
+// OnPeerLeft, but the reliable packets they were waiting on acks for fail.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.stopBackground != nil {
+		s.stopBackground()
+	}
+	s.isOpen = false
+	peers := s.peers
+	s.peers = make(map[string]*Connection)
+	s.Socket.Close()
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		peer.mu.Lock()
+		peer.isOpen = false
+		peer.failReliable()
+		peer.unlock()
+	}
+}
+
+// IsOpen returns true if the Server's Socket hasn't been closed.
+func (s *Server) IsOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isOpen
+}
+
+// SetChannelMode sets the delivery mode for the channel ch on all current
+// and future peers. It fails if a current peer has already used the channel
+// with a different mode.
+func (s *Server) SetChannelMode(ch uint8, mode DeliveryMode) error {
+	for _, peer := range s.peerList(false) {
+		err := peer.SetChannelMode(ch, mode)
+		if err != nil {
+			return err
+		}
+	}
+	if ch > MaxChannel {
+		return fmt.Errorf("Channel %d is out of range; the maximum is %d.", ch, MaxChannel)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channelModes[ch] = mode
+	return nil
+}
+
+// GetStats returns a copy of the counters for datagrams rejected before
+// they reached a peer.
+func (s *Server) GetStats() ConnectionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	if s.lobby != nil {
+		lobbyStats := s.lobby.GetStats()
+		stats.DecryptFailures += lobbyStats.DecryptFailures
+		stats.MalformedPackets += lobbyStats.MalformedPackets
+		stats.AmplificationDropped += lobbyStats.AmplificationDropped
+		stats.IncompatibleVersions += lobbyStats.IncompatibleVersions
+	}
+	return stats
+}
+
+// GetPeer returns the peer Connection for the remote address, or nil if
+// the address hasn't joined the server.
+func (s *Server) GetPeer(remote net.Addr) *Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer := s.peers[remote.String()]
+	if peer == nil || !peer.joined {
+		return nil
+	}
+	return peer
+}
+
+// GetPeerCount returns the number of peers that have joined the server.
+func (s *Server) GetPeerCount() int {
+	return len(s.peerList(true))
+}
+
+// ForEachPeer calls f for every peer that has joined the server. Iteration
+// stops early if f returns false. Peers may be removed from within f.
+func (s *Server) ForEachPeer(f func(peer *Connection) bool) {
+	for _, peer := range s.peerList(true) {
+		if !f(peer) {
+			return
+		}
+	}
+}
+
+// peerList returns a snapshot of the server's peers so they can be worked
+// on without holding the server's lock; if joined is true, only the peers
+// that have joined are returned.
+func (s *Server) peerList(joined bool) []*Connection {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]*Connection, 0, len(s.peers))
+	for _, peer := range s.peers {
+		if !joined || peer.joined {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// RemovePeer drops the peer from the server, firing OnPeerLeft if the
+// peer had joined.
+func (s *Server) RemovePeer(peer *Connection) {
+	s.mu.Lock()
+	key := peer.RemoteAddress.String()
+	if s.peers[key] != peer {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.peers, key)
+	joined := peer.joined
+	peer.joined = false
+	s.mu.Unlock()
+
+	peer.mu.Lock()
+	peer.isOpen = false
+	peer.failReliable()
+	peer.unlock()
+	if joined && s.OnPeerLeft != nil {
+		s.OnPeerLeft(s, peer)
+	}
+}
+
+// Read attempts to read a UDP packet from the Socket in a synchronous way and
+// hands it to the Connection for the address it came from, creating that
+// Connection if this is the first packet from the address. The peer and the
+// packet are returned and OnPacketRead is fired if it's set.
+func (s *Server) Read() (*Connection, *Packet, error) {
+	// packets released from a peer's ordered channel are delivered first
+	for _, peer := range s.peerList(false) {
+		peer.mu.Lock()
+		p := peer.popPending()
+		peer.unlock()
+		if p != nil {
+			s.firePacketRead(peer, p)
+			return peer, p, nil
+		}
+	}
+
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	for {
+		n, addr, err := s.Socket.ReadFrom(s.buffer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to read bytes from UDP: %w\n", err)
+		}
+
+		b, peer, isNew, err := s.routeDatagram(s.buffer[:n], addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if peer == nil {
+			continue
+		}
+		if isNew && s.OnPeerCreated != nil {
+			s.OnPeerCreated(s, peer)
+		}
+
+		peer.mu.Lock()
+		p, deliver, err := peer.handleDatagram(b, addr)
+		connected := peer.state == StateConnected
+		peer.unlock()
+
+		if isNew {
+			// don't hold on to state for addresses that only sent garbage,
+			// were refused by the handshake or, without a handshake, only
+			// sent a control message such as a stray disconnect
+			keep := err == nil && connected
+			if !s.RequireHandshake {
+				keep = err == nil && deliver
+			}
+			if !keep {
+				s.mu.Lock()
+				if s.peers[addr.String()] == peer {
+					delete(s.peers, addr.String())
+				}
+				s.mu.Unlock()
+			} else if !s.RequireHandshake {
+				s.peerJoined(peer)
+			}
+		}
+		if err != nil {
+			return peer, nil, err
+		}
+		if !deliver {
+			// the datagram may still have released packets held on an
+			// ordered channel, which go out before anything read later
+			peer.mu.Lock()
+			p = peer.popPending()
+			peer.unlock()
+			if p == nil {
+				continue
+			}
+		}
+
+		s.firePacketRead(peer, p)
+		return peer, p, nil
+	}
+}
+
+// routeDatagram runs the datagram b read from addr through the Filter,
+// RateLimit and framing checks and finds the peer it's for, creating it if
+// needed. The unframed bytes are returned along with the peer, which is nil
+// if the datagram was dropped or handled by the lobby.
+func (s *Server) routeDatagram(b []byte, addr net.Addr) ([]byte, *Connection, bool, error) {
+	// the filter and rate limiter run without the lock so that they, and
+	// OnLimited, can call back into the server
+	if s.Filter != nil && !s.Filter.Accept(addr) {
+		s.mu.Lock()
+		s.stats.FilteredDropped++
+		s.mu.Unlock()
+		return nil, nil, false, nil
+	}
+	if s.RateLimit != nil && !s.RateLimit.Allow(addr, len(b)) {
+		s.mu.Lock()
+		s.stats.RateLimited++
+		s.mu.Unlock()
+		return nil, nil, false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := unframeDatagram(b, s.ProtocolId, s.UseChecksum, &s.stats)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("Failed to read packet from UDP: %w", err)
+	}
+
+	if peer := s.peers[addr.String()]; peer != nil {
+		return b, peer, false, nil
+	}
+	if s.RequireHandshake && !s.readUnverified(b, addr) {
+		return nil, nil, false, nil
+	}
+	return b, s.newPeer(addr), true, nil
+}
+
+// Tick tries to read a packet and then resends any reliable packets, sends
+// keepalives and checks for idle timeouts for all peers as necessary.
+// Returns a bool indicating if a packet was read and a possible error.
+func (s *Server) Tick() (bool, error) {
+	s.Socket.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	_, p, err := s.Read()
+	gotPacket := err == nil && p != nil
+
+	return gotPacket, s.updatePeers()
+}
+
+// updatePeers resends packets, sends keepalives and checks for idle
+// timeouts for every peer.
+func (s *Server) updatePeers() error {
+	for _, peer := range s.peerList(false) {
+		peer.mu.Lock()
+		err := peer.update()
+		peer.unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firePacketRead fires the server's and the peer's OnPacketRead events.
+func (s *Server) firePacketRead(peer *Connection, p *Packet) {
+	if s.OnPacketRead != nil {
+		s.OnPacketRead(s, peer, p)
+	}
+	if peer.OnPacketRead != nil {
+		peer.OnPacketRead(peer, p)
+	}
+}
+
+// readUnverified handles a datagram from an address without a peer when
+// RequireHandshake is set. Connect requests are answered from the server's
+// lobby Connection, which keeps no state for the address. Returns true if
+// the datagram is a challenge response with a valid cookie, meaning a peer
+// should be made for the address.
+func (s *Server) readUnverified(b []byte, addr net.Addr) bool {
+	if s.lobby == nil {
+		s.lobby = New(0)
+		s.lobby.isOpen = true
+	}
+	s.lobby.mu.Lock()
+	defer s.lobby.unlock()
+	s.configure(s.lobby)
+
+	p := s.lobby.readUnverified(b, addr)
+	if p == nil {
+		return false
+	}
+	defer ReleasePacket(p)
+	if p.Chan != ControlChannel {
+		return false
+	}
+	if s.lobby.isCookieResponse(p) {
+		return true
+	}
+	s.lobby.handleControl(p)
+	return false
+}
+
+// newPeer creates the Connection used for a new remote address. The caller
+// fires OnPeerCreated once the server is unlocked.
+func (s *Server) newPeer(remote net.Addr) *Connection {
+	peer := New(0)
+	s.configure(peer)
+	peer.server = s
+	peer.RemoteAddress = remote
+	peer.OnConnected = func(c *Connection) {
+		s.peerJoined(c)
+	}
+	for ch, mode := range s.channelModes {
+		peer.SetChannelMode(ch, mode)
+	}
+	peer.isOpen = true
+
+	s.peers[remote.String()] = peer
+	return peer
+}
+
+// configure copies the server's settings to a peer Connection.
+func (s *Server) configure(peer *Connection) {
+	peer.Socket = s.Socket
+	peer.ListenAddress = s.ListenAddress
+	peer.ProtocolId = s.ProtocolId
+	peer.UseChecksum = s.UseChecksum
+	peer.RequireHandshake = s.RequireHandshake
+	peer.OnConnectRequest = s.OnConnectRequest
+	peer.KeepAliveInterval = s.KeepAliveInterval
+	peer.IdleTimeout = s.IdleTimeout
+	peer.OnDisconnected = s.OnDisconnected
+	peer.KeyExchange = s.KeyExchange
+	peer.StaticKey = s.StaticKey
+	peer.AdaptiveRetry = s.AdaptiveRetry
+	peer.ReliableFragments = s.ReliableFragments
+	peer.Clock = s.Clock
+	peer.MaxPayloadSize = s.MaxPayloadSize
+	peer.CompactHeaders = s.CompactHeaders
+	peer.MinProtocolVersion = s.MinProtocolVersion
+	peer.Features = s.Features
+
+	// every peer checks the cookies handed out by the lobby
+	peer.cookieKey = s.cookieKey
+}
+
+// peerJoined marks the peer as joined and fires OnPeerJoined.
+func (s *Server) peerJoined(peer *Connection) {
+	s.mu.Lock()
+	if peer.joined {
+		s.mu.Unlock()
+		return
+	}
+	peer.joined = true
+	s.mu.Unlock()
+
+	if s.OnPeerJoined != nil {
+		s.OnPeerJoined(s, peer)
+	}
+}
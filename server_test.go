@@ -0,0 +1,131 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	serverTestPort = 42010
+)
+
+const (
+	// the clients send bursts of packets, so give the socket some room
+	serverTestBufferSize = 64 * 1024
+)
+
+func TestServerPeers(t *testing.T) {
+	server, err := NewServer(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", serverTestPort))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+
+	joined, left := 0, 0
+	server.OnPeerJoined = func(s *Server, peer *Connection) {
+		joined++
+	}
+	server.OnPeerLeft = func(s *Server, peer *Connection) {
+		left++
+	}
+
+	// each client sends a different number of packets
+	const clientCount = 2
+	var clients [clientCount]*Connection
+	for i := 0; i < clientCount; i++ {
+		clients[i], err = NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", serverTestPort))
+		if err != nil {
+			t.Fatalf("Failed to create client %d.\n%v", i, err)
+		}
+		defer clients[i].Close()
+
+		for j := 0; j <= i*3; j++ {
+			testPayload := []byte(fmt.Sprintf("PING%d", j))
+			err = clients[i].Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+			if err != nil {
+				t.Fatalf("Client %d failed to send data.\n%v", i, err)
+			}
+		}
+	}
+
+	// client 0 sent 1 packet and client 1 sent 4 packets
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 5; i++ {
+		peer, p, err := server.Read()
+		if err != nil {
+			t.Fatalf("Server failed to read data.\n%v", err)
+		}
+		if !sameAddr(peer.RemoteAddress, p.RemoteAddress) {
+			t.Errorf("Packet from %v was routed to peer %v.", p.RemoteAddress, peer.RemoteAddress)
+		}
+	}
+
+	if joined != clientCount || server.GetPeerCount() != clientCount {
+		t.Fatalf("Server should have %d peers but has %d (joined %d).", clientCount, server.GetPeerCount(), joined)
+	}
+
+	// each peer should have its own ack state
+	for i := 0; i < clientCount; i++ {
+		peer := server.GetPeer(clients[i].Socket.LocalAddr().(*net.UDPAddr))
+		if peer == nil {
+			t.Fatalf("Server has no peer for client %d.", i)
+		}
+		expectedSeq := uint32(i*3 + 1)
+		if peer.GetLastSeenSeq() != expectedSeq {
+			t.Errorf("Peer %d should have last seen seq %d but has %d.", i, expectedSeq, peer.GetLastSeenSeq())
+		}
+	}
+
+	// closing a peer removes it from the server but keeps the socket
+	count := 0
+	server.ForEachPeer(func(peer *Connection) bool {
+		count++
+		peer.Close()
+		return true
+	})
+	if count != clientCount || left != clientCount || server.GetPeerCount() != 0 {
+		t.Errorf("Server should have removed %d peers (iterated %d, left %d, remaining %d).",
+			clientCount, count, left, server.GetPeerCount())
+	}
+	if !server.IsOpen() {
+		t.Errorf("Closing a peer should not close the server.")
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	server, err := NewServer(serverTestBufferSize, fmt.Sprintf("127.0.0.1:%d", serverTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+
+	joined := 0
+	server.OnPeerJoined = func(s *Server, peer *Connection) {
+		joined++
+	}
+
+	client, err := NewConnection(testServerBufferSize, "", fmt.Sprintf("127.0.0.1:%d", serverTestPort+1))
+	if err != nil {
+		t.Fatalf("Failed to create the client.\n%v", err)
+	}
+	defer client.Close()
+	client.Connect(nil)
+
+	endTime := time.Now().Add(time.Second * 2)
+	for time.Now().Before(endTime) && client.State() != StateConnected {
+		server.Tick()
+		client.Tick()
+	}
+	if client.State() != StateConnected {
+		t.Fatalf("Client failed to connect to the server (%v).", client.State())
+	}
+	if joined != 1 || server.GetPeerCount() != 1 {
+		t.Errorf("Server should have one joined peer but has %d (joined %d).", server.GetPeerCount(), joined)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// LinkConditions describes how a SimulatedConn mistreats the datagrams
+// written to it. The zero value passes everything through untouched.
+type LinkConditions struct {
+	// Loss is the chance, from 0 to 1, that a datagram is dropped.
+	Loss float64
+
+	// Latency is how long every datagram is delayed, and Jitter is the most
+	// that's randomly added on top of it.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Duplicate is the chance, from 0 to 1, that a datagram is sent twice.
+	Duplicate float64
+
+	// Reorder is the chance, from 0 to 1, that a datagram is held back by an
+	// extra ReorderDelay so that the datagrams after it arrive first. A zero
+	// ReorderDelay defaults to 10ms.
+	Reorder      float64
+	ReorderDelay time.Duration
+
+	// BytesPerSecond caps the bandwidth of the link; datagrams queue up
+	// behind each other once it's reached. A zero value doesn't cap it.
+	BytesPerSecond float64
+
+	// QueueLimit is the longest a datagram can wait for bandwidth before it's
+	// dropped, the way a router's full buffer drops packets. A zero value
+	// never drops datagrams for waiting.
+	QueueLimit time.Duration
+}
+
+// SimulatorStats holds counters kept by a SimulatedConn.
+type SimulatorStats struct {
+	Written    uint64
+	Dropped    uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+// SimulatedConn wraps a net.PacketConn, such as a MemoryNetwork connection,
+// and applies LinkConditions to every datagram written to it. Reads are
+// passed straight through, so wrap both ends to mistreat both directions.
+// The random choices come from a seeded generator, so the same seed and the
+// same writes make the same choices every run.
+type SimulatedConn struct {
+	net.PacketConn
+
+	conditions LinkConditions
+	rng        *rand.Rand
+	linkFree   time.Time
+	stats      SimulatorStats
+	closed     bool
+	mu         sync.Mutex
+}
+
+const (
+	defaultReorderDelay = time.Millisecond * 10
+)
+
+// NewSimulatedConn wraps the transport in a SimulatedConn with the
+// conditions supplied and the seed for its random choices.
+func NewSimulatedConn(transport net.PacketConn, conditions LinkConditions, seed int64) *SimulatedConn {
+	s := new(SimulatedConn)
+	s.PacketConn = transport
+	s.conditions = conditions
+	s.rng = rand.New(rand.NewSource(seed))
+	return s
+}
+
+// SetConditions changes the conditions applied to datagrams written from
+// now on.
+func (s *SimulatedConn) SetConditions(conditions LinkConditions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conditions = conditions
+}
+
+// GetStats returns a copy of the simulator's counters.
+func (s *SimulatedConn) GetStats() SimulatorStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// WriteTo applies the link conditions to the datagram and schedules it, and
+// any duplicate of it, to be written to the wrapped transport. The datagram
+// is reported as written even if the link drops it, just like UDP.
+func (s *SimulatedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, &net.OpError{Op: "write", Net: "simulated", Addr: addr, Err: net.ErrClosed}
+	}
+	s.stats.Written++
+
+	cond := s.conditions
+	if s.chance(cond.Loss) {
+		s.stats.Dropped++
+		return len(b), nil
+	}
+
+	// the datagram waits for the bandwidth used by the ones before it
+	t := time.Now()
+	var queued time.Duration
+	if cond.BytesPerSecond > 0 {
+		if s.linkFree.Before(t) {
+			s.linkFree = t
+		}
+		queued = s.linkFree.Sub(t)
+		if cond.QueueLimit > 0 && queued > cond.QueueLimit {
+			s.stats.Dropped++
+			return len(b), nil
+		}
+		s.linkFree = s.linkFree.Add(time.Duration(float64(len(b)) / cond.BytesPerSecond * float64(time.Second)))
+	}
+
+	copies := 1
+	if s.chance(cond.Duplicate) {
+		s.stats.Duplicated++
+		copies = 2
+	}
+
+	datagram := append([]byte(nil), b...)
+	for i := 0; i < copies; i++ {
+		delay := queued + cond.Latency
+		if cond.Jitter > 0 {
+			delay += time.Duration(s.rng.Int63n(int64(cond.Jitter) + 1))
+		}
+		if s.chance(cond.Reorder) {
+			s.stats.Reordered++
+			if cond.ReorderDelay > 0 {
+				delay += cond.ReorderDelay
+			} else {
+				delay += defaultReorderDelay
+			}
+		}
+		s.schedule(datagram, addr, delay)
+	}
+
+	return len(b), nil
+}
+
+// Close closes the wrapped transport; datagrams still waiting on the link
+// are dropped.
+func (s *SimulatedConn) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.PacketConn.Close()
+}
+
+// chance returns true with the probability p.
+func (s *SimulatedConn) chance(p float64) bool {
+	return p > 0 && s.rng.Float64() < p
+}
+
+// schedule writes the datagram to the wrapped transport after the delay.
+func (s *SimulatedConn) schedule(b []byte, addr net.Addr, delay time.Duration) {
+	if delay <= 0 {
+		s.PacketConn.WriteTo(b, addr)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if !closed {
+			s.PacketConn.WriteTo(b, addr)
+		}
+	})
+}
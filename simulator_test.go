@@ -0,0 +1,181 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	simulatorTestSeed = 20160101
+)
+
+// simulatedPair makes a sender on a SimulatedConn and a plain receiver on a
+// MemoryNetwork.
+func simulatedPair(t *testing.T, conditions LinkConditions, seed int64) (*SimulatedConn, *MemoryConn) {
+	network := NewMemoryNetwork()
+	sender, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	receiver, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	return NewSimulatedConn(sender, conditions, seed), receiver
+}
+
+// readAll reads datagrams until none arrive for the wait duration.
+func readAll(receiver *MemoryConn, wait time.Duration) []string {
+	var got []string
+	buffer := make([]byte, 64)
+	for {
+		receiver.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := receiver.ReadFrom(buffer)
+		if err != nil {
+			return got
+		}
+		got = append(got, string(buffer[:n]))
+	}
+}
+
+func TestSimulatedConditions(t *testing.T) {
+	conditions := LinkConditions{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1, Jitter: time.Millisecond * 2}
+	const count = 200
+
+	// the same seed drops, duplicates and reorders the same datagrams
+	var runs [2][]string
+	var stats [2]SimulatorStats
+	for run := range runs {
+		sender, receiver := simulatedPair(t, conditions, simulatorTestSeed)
+		for i := 0; i < count; i++ {
+			sender.WriteTo([]byte(fmt.Sprintf("%03d", i)), receiver.LocalAddr())
+		}
+		runs[run] = readAll(receiver, time.Millisecond*50)
+		stats[run] = sender.GetStats()
+		sender.Close()
+	}
+
+	if stats[0] != stats[1] {
+		t.Errorf("Runs with the same seed had different stats: %+v and %+v.", stats[0], stats[1])
+	}
+	s := stats[0]
+	if s.Written != count || s.Dropped == 0 || s.Duplicated == 0 || s.Reordered == 0 {
+		t.Errorf("Simulator didn't apply every condition: %+v.", s)
+	}
+	expected := int(s.Written - s.Dropped + s.Duplicated)
+	if len(runs[0]) != expected {
+		t.Errorf("Receiver should have read %d datagrams but read %d.", expected, len(runs[0]))
+	}
+
+	outOfOrder := false
+	for i := 1; i < len(runs[0]); i++ {
+		outOfOrder = outOfOrder || runs[0][i] < runs[0][i-1]
+	}
+	if !outOfOrder {
+		t.Errorf("Some datagrams should have arrived out of order.")
+	}
+}
+
+func TestSimulatedLatency(t *testing.T) {
+	const latency = time.Millisecond * 50
+	sender, receiver := simulatedPair(t, LinkConditions{Latency: latency}, simulatorTestSeed)
+	defer sender.Close()
+
+	start := time.Now()
+	sender.WriteTo([]byte("PING"), receiver.LocalAddr())
+	got := readAll(receiver, time.Millisecond*200)
+	if len(got) != 1 {
+		t.Fatalf("Receiver should have read 1 datagram but read %d.", len(got))
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Errorf("Datagram arrived after %v, before the latency of %v.", elapsed, latency)
+	}
+
+	// at 1000 bytes a second, the fifth 100 byte datagram waits 400ms for
+	// the ones before it, which is over the queue limit
+	sender.SetConditions(LinkConditions{BytesPerSecond: 1000, QueueLimit: time.Millisecond * 350})
+	for i := 0; i < 5; i++ {
+		sender.WriteTo(make([]byte, 100), receiver.LocalAddr())
+	}
+	if dropped := sender.GetStats().Dropped; dropped != 1 {
+		t.Errorf("Simulator should have dropped 1 datagram over the queue limit but dropped %d.", dropped)
+	}
+	start = time.Now()
+	got = readAll(receiver, time.Millisecond*500)
+	if len(got) != 4 {
+		t.Errorf("Receiver should have read 4 datagrams but read %d.", len(got))
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*300 {
+		t.Errorf("Datagrams arrived after %v, faster than the bandwidth allows.", elapsed)
+	}
+}
+
+// TestSimulatedReliability sends a stream of reliable ordered packets over
+// a lossy, jittery link in both directions and checks that every packet is
+// read exactly once and in order.
+func TestSimulatedReliability(t *testing.T) {
+	conditions := LinkConditions{
+		Loss:      0.2,
+		Latency:   time.Millisecond * 5,
+		Jitter:    time.Millisecond * 10,
+		Duplicate: 0.05,
+		Reorder:   0.1,
+	}
+
+	network := NewMemoryNetwork()
+	listenerConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	listener := NewTransportConnection(testServerBufferSize, NewSimulatedConn(listenerConn, conditions, simulatorTestSeed), clientConn.LocalAddr())
+	defer listener.Close()
+	client := NewTransportConnection(testServerBufferSize, NewSimulatedConn(clientConn, conditions, simulatorTestSeed+1), listenerConn.LocalAddr())
+	defer client.Close()
+
+	for _, c := range []*Connection{listener, client} {
+		c.SetChannelMode(1, ReliableOrdered)
+		c.KeepAliveInterval = time.Millisecond * 10
+		c.AdaptiveRetry = true
+		c.ReliableRetryInterval = time.Millisecond * 50
+		c.ReliableRetryCount = 50
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	packets, err := listener.Start(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start the listener.\n%v", err)
+	}
+	if _, err := client.Start(ctx); err != nil {
+		t.Fatalf("Failed to start the client.\n%v", err)
+	}
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		payload := []byte(fmt.Sprintf("%03d", i))
+		err = client.Send(NewPacket(42, 0, 1, 0, 0, uint32(len(payload)), payload), true, nil)
+		if err != nil {
+			t.Fatalf("Client failed to send data.\n%v", err)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case p := <-packets:
+			if got, expected := string(p.Payload[:p.PayloadSize]), fmt.Sprintf("%03d", i); got != expected {
+				t.Fatalf("Listener read %s when %s was expected.", got, expected)
+			}
+		case <-ctx.Done():
+			t.Fatalf("Listener only read %d of %d packets.", i, count)
+		}
+	}
+}
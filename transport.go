@@ -0,0 +1,286 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// NewTransportConnection creates a new Connection that sends and reads
+// datagrams on the transport supplied, which can be any net.PacketConn such
+// as a UDP or Unix datagram socket or a MemoryNetwork connection. The
+// remoteAddress is used as the RemoteAddress and may be nil. The connection
+// takes over the transport and closes it when the connection is closed.
+func NewTransportConnection(bufferSize uint32, transport net.PacketConn, remoteAddress net.Addr) *Connection {
+	newConn := New(bufferSize)
+	newConn.Socket = transport
+	newConn.ListenAddress = transport.LocalAddr()
+	if !isNilAddr(remoteAddress) {
+		newConn.RemoteAddress = remoteAddress
+	}
+	newConn.isOpen = true
+	return newConn
+}
+
+// NewTransportServer creates a new Server that reads datagrams for all of
+// its peers on the transport supplied, the same way NewTransportConnection()
+// does for a single Connection.
+func NewTransportServer(bufferSize uint32, transport net.PacketConn) (*Server, error) {
+	s := new(Server)
+	s.buffer = make([]byte, bufferSize)
+	s.peers = make(map[string]*Connection)
+	s.channelModes = make(map[uint8]DeliveryMode)
+	s.ReadTimeout = time.Millisecond
+	s.UpdateInterval = defaultUpdateInterval
+
+	// the key for the handshake cookies is shared by all peers
+	s.cookieKey = make([]byte, cookieKeySize)
+	if _, err := rand.Read(s.cookieKey); err != nil {
+		return nil, fmt.Errorf("Failed to generate the cookie key.\n%v", err)
+	}
+
+	s.Socket = transport
+	s.ListenAddress = transport.LocalAddr()
+	s.isOpen = true
+	return s, nil
+}
+
+// isNilAddr returns true if the address is nil, including a nil *net.UDPAddr
+// stored in a net.Addr.
+func isNilAddr(addr net.Addr) bool {
+	if addr == nil {
+		return true
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	return ok && udpAddr == nil
+}
+
+const (
+	// the number of datagrams a MemoryNetwork connection holds before it
+	// starts dropping new ones, the way a full socket buffer would
+	memoryQueueSize = 256
+)
+
+// MemoryNetwork is an in-memory network of datagram transports that never
+// leave the process, which is useful for tests. Connections on it are made
+// with Listen() and have UDP addresses, so they work with a Banlist and
+// the other address based features. Datagrams sent to an address nobody is
+// listening on are dropped, just like with UDP.
+type MemoryNetwork struct {
+	conns    map[string]*MemoryConn
+	nextPort int
+	mu       sync.Mutex
+}
+
+// MemoryConn is a net.PacketConn on a MemoryNetwork.
+type MemoryConn struct {
+	network *MemoryNetwork
+	addr    *net.UDPAddr
+	queue   chan memoryDatagram
+	closed  chan struct{}
+
+	// readWake is closed and replaced whenever the read deadline changes
+	// so that a blocked ReadFrom() notices
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readWake      chan struct{}
+	closeOnce     sync.Once
+	mu            sync.Mutex
+}
+
+type memoryDatagram struct {
+	b    []byte
+	from *net.UDPAddr
+}
+
+// NewMemoryNetwork creates an empty MemoryNetwork.
+func NewMemoryNetwork() *MemoryNetwork {
+	n := new(MemoryNetwork)
+	n.conns = make(map[string]*MemoryConn)
+	n.nextPort = 10000
+	return n
+}
+
+// Listen creates a connection on the network at the address, which takes
+// the same form as for NewConnection(). A port of 0 picks an unused port.
+func (n *MemoryNetwork) Listen(address string) (*MemoryConn, error) {
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the address to listen on: %s\n%v", address, err)
+	}
+	ip := net.ParseIP(host)
+	portNum, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Failed to parse the address to listen on: %s", address)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	addr := &net.UDPAddr{IP: ip, Port: portNum}
+	for addr.Port == 0 || n.conns[addr.String()] != nil {
+		if portNum != 0 {
+			return nil, fmt.Errorf("Failed to listen on the address: %s\nThe address is in use.", address)
+		}
+		n.nextPort++
+		addr.Port = n.nextPort
+	}
+
+	c := &MemoryConn{
+		network:  n,
+		addr:     addr,
+		queue:    make(chan memoryDatagram, memoryQueueSize),
+		closed:   make(chan struct{}),
+		readWake: make(chan struct{}),
+	}
+	n.conns[addr.String()] = c
+	return c, nil
+}
+
+// ReadFrom reads the next datagram sent to the connection.
+func (c *MemoryConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline, wake := c.readDeadline, c.readWake
+		c.mu.Unlock()
+
+		select {
+		case <-c.closed:
+			return 0, nil, c.opError("read", net.ErrClosed)
+		default:
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		n, from, woken, err := c.waitForDatagram(b, timeout, wake)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !woken {
+			return n, from, err
+		}
+	}
+}
+
+// waitForDatagram blocks until a datagram arrives, the connection is closed,
+// the timeout passes or the read deadline is changed, in which case woken is
+// true and the read should start over.
+func (c *MemoryConn) waitForDatagram(b []byte, timeout <-chan time.Time, wake chan struct{}) (int, net.Addr, bool, error) {
+	select {
+	case d := <-c.queue:
+		// like UDP, whatever doesn't fit in b is lost
+		return copy(b, d.b), d.from, false, nil
+	case <-c.closed:
+		return 0, nil, false, c.opError("read", net.ErrClosed)
+	case <-timeout:
+		return 0, nil, false, c.opError("read", os.ErrDeadlineExceeded)
+	case <-wake:
+		return 0, nil, true, nil
+	}
+}
+
+// WriteTo sends the datagram to the connection listening at addr. Writes
+// never block; the datagram is dropped if the other side's queue is full.
+func (c *MemoryConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	c.network.deliver(memoryDatagram{b: append([]byte(nil), b...), from: c.addr}, addr)
+	return len(b), nil
+}
+
+// deliver queues the datagram on the connection listening at addr.
+func (n *MemoryNetwork) deliver(d memoryDatagram, addr net.Addr) {
+	if isNilAddr(addr) {
+		return
+	}
+	n.mu.Lock()
+	to := n.conns[addr.String()]
+	n.mu.Unlock()
+	if to == nil {
+		return
+	}
+
+	select {
+	case to.queue <- d:
+	default:
+	}
+}
+
+// Close removes the connection from the network and wakes up any reads.
+func (c *MemoryConn) Close() error {
+	closed := false
+	c.closeOnce.Do(func() {
+		closed = true
+		close(c.closed)
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr.String())
+		c.network.mu.Unlock()
+	})
+	if !closed {
+		return c.opError("close", net.ErrClosed)
+	}
+	return nil
+}
+
+// LocalAddr returns the address the connection is listening on.
+func (c *MemoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *MemoryConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the time after which ReadFrom() fails; a zero value
+// means reads never time out.
+func (c *MemoryConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	close(c.readWake)
+	c.readWake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline sets the time after which WriteTo() fails; a zero value
+// means writes never time out.
+func (c *MemoryConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+func (c *MemoryConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "memory", Addr: c.addr, Err: err}
+}
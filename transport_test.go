@@ -0,0 +1,141 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	serverConn, err := network.Listen("10.0.0.1:5000")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	if _, err := network.Listen("10.0.0.1:5000"); err == nil {
+		t.Errorf("Listening on an address in use should fail.")
+	}
+
+	server, err := NewTransportServer(testServerBufferSize, serverConn)
+	if err != nil {
+		t.Fatalf("Failed to create the server.\n%v", err)
+	}
+	defer server.Close()
+	server.RequireHandshake = true
+	server.KeyExchange = true
+
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	client := NewTransportConnection(testServerBufferSize, clientConn, serverConn.LocalAddr())
+	defer client.Close()
+	client.KeyExchange = true
+
+	// the whole handshake, key exchange included, runs over the memory network
+	err = client.Connect(nil)
+	if err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	for i := 0; i < 100 && client.State() != StateConnected; i++ {
+		server.Tick()
+		client.Tick()
+	}
+	if client.State() != StateConnected {
+		t.Fatalf("Client should be connected but is %v.", client.State())
+	}
+
+	testPayload := []byte("PING")
+	err = client.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload), true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+	server.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	peer, p, err := server.Read()
+	if err != nil {
+		t.Fatalf("Server failed to read data.\n%v", err)
+	}
+	if string(p.Payload[:p.PayloadSize]) != string(testPayload) {
+		t.Errorf("Server read %q instead of %q.", p.Payload[:p.PayloadSize], testPayload)
+	}
+	if !sameAddr(peer.RemoteAddress, clientConn.LocalAddr()) {
+		t.Errorf("Packet was read from %v instead of %v.", peer.RemoteAddress, clientConn.LocalAddr())
+	}
+
+	// reads honor deadlines and closing
+	client.Socket.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	_, err = client.Read()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read should have timed out but returned: %v", err)
+	}
+	client.Socket.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		client.Close()
+	}()
+	_, err = client.Read()
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Read should have failed on the closed transport but returned: %v", err)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	dir := t.TempDir()
+	listenerAddr := &net.UnixAddr{Name: filepath.Join(dir, "listener.sock"), Net: "unixgram"}
+	clientAddr := &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"}
+
+	listenerConn, err := net.ListenUnixgram("unixgram", listenerAddr)
+	if err != nil {
+		t.Skipf("Unix datagram sockets aren't available.\n%v", err)
+	}
+	listener := NewTransportConnection(testServerBufferSize, listenerConn, clientAddr)
+	defer listener.Close()
+
+	clientConn, err := net.ListenUnixgram("unixgram", clientAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen on the client socket.\n%v", err)
+	}
+	client := NewTransportConnection(testServerBufferSize, clientConn, listenerAddr)
+	defer client.Close()
+
+	acked := false
+	testPayload := []byte("PING")
+	rp := NewPacket(42, 0, 0, 0, 0, uint32(len(testPayload)), testPayload).MakeReliable(time.Second, 3)
+	rp.OnAck = func(c *Connection, rp *ReliablePacket) {
+		acked = true
+	}
+	err = client.SendReliable(rp, true, nil)
+	if err != nil {
+		t.Fatalf("Client failed to send data.\n%v", err)
+	}
+
+	listener.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	p, err := listener.Read()
+	if err != nil {
+		t.Fatalf("Listener failed to read data.\n%v", err)
+	}
+	if !sameAddr(p.RemoteAddress, clientAddr) {
+		t.Errorf("Packet was read from %v instead of %v.", p.RemoteAddress, clientAddr)
+	}
+
+	// the reply carries the ack back to the client
+	pong := []byte("PONG")
+	err = listener.Send(NewPacket(42, 0, 0, 0, 0, uint32(len(pong)), pong), true, nil)
+	if err != nil {
+		t.Fatalf("Listener failed to send data.\n%v", err)
+	}
+	client.Socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read()
+	if err != nil {
+		t.Fatalf("Client failed to read data.\n%v", err)
+	}
+	if !acked {
+		t.Errorf("Client's reliable packet should have been acked.")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+// See the LICENSE file for more details.
+
+package netpeddler
+
+// ProtocolVersion is the version of the wire format spoken by this package.
+// It's exchanged at the start of the handshake along with the optional
+// features each side supports, and both sides use the older of their two
+// versions for the session. Remote sides from before the version exchange
+// don't send one and are treated as speaking version 1.
+const ProtocolVersion uint8 = 2
+
+// Feature is a bitfield of optional features that are negotiated with each
+// remote side during the handshake. A feature is only used for a session if
+// both sides offer it.
+type Feature uint32
+
+const (
+	// FeatureCompactHeaders is the compact packet header offered with
+	// CompactHeaders.
+	FeatureCompactHeaders Feature = 1 << iota
+
+	// FeatureEncryption is the key exchange offered with KeyExchange. Unlike
+	// the other features, a handshake where only one side offers it is
+	// rejected with RejectKeyExchange instead of going ahead without it.
+	FeatureEncryption
+
+	// FeatureUser is the first feature bit available for application use,
+	// such as a payload compression scheme the application implements
+	// itself and only turns on when GetFeatures() says the remote side has
+	// it too.
+	FeatureUser Feature = 1 << 16
+)
+
+// The connecting side offers its version, the oldest version it accepts and
+// its features after the padding of the connect request. The accepting side
+// answers with the version and features agreed on after the challenge cookie,
+// so they're covered by the cookie's HMAC. Older versions ignore the offer
+// and never answer it.
+const (
+	offerSize     = 6
+	agreementSize = 5
+
+	// legacyVersion is the version spoken by remote sides that don't send one
+	legacyVersion uint8 = 1
+
+	// keySaltVersion is the first version where the connecting side sends
+	// a random salt after the cookie in its challenge response, which is
+	// used along with the cookie to derive the session's keys
+	keySaltVersion uint8 = 2
+
+	// randomNonceVersion is the first version that seals packets with a
+	// random nonce after the counter instead of using the counter as the
+	// nonce
+	randomNonceVersion uint8 = 2
+)
+
+// offeredFeatures returns the optional features the connection offers.
+func (c *Connection) offeredFeatures() Feature {
+	f := c.Features
+	if c.CompactHeaders {
+		f |= FeatureCompactHeaders
+	}
+	if c.KeyExchange {
+		f |= FeatureEncryption
+	}
+	return f
+}
+
+// acceptsVersion returns true if the connection can speak version v.
+func (c *Connection) acceptsVersion(v uint8) bool {
+	return v >= legacyVersion && v <= ProtocolVersion && v >= c.MinProtocolVersion
+}
+
+// appendOffer appends the connection's version offer to b.
+func (c *Connection) appendOffer(b []byte) []byte {
+	b = append(b, ProtocolVersion, c.MinProtocolVersion)
+	return byteOrder.AppendUint32(b, uint32(c.offeredFeatures()))
+}
+
+// parseOffer reads a version offer.
+func parseOffer(b []byte) (version uint8, minVersion uint8, features Feature) {
+	return b[0], b[1], Feature(byteOrder.Uint32(b[2:]))
+}
+
+// agree works out the version and features for a session with a remote side
+// that made the offer supplied, returning false if there's no version both
+// sides accept.
+func (c *Connection) agree(version, minVersion uint8, features Feature) (uint8, Feature, bool) {
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if !c.acceptsVersion(version) || version < minVersion {
+		return 0, 0, false
+	}
+	return version, features & c.offeredFeatures(), true
+}
+
+// appendAgreement appends the version and features agreed on to b.
+func appendAgreement(b []byte, version uint8, features Feature) []byte {
+	b = append(b, version)
+	return byteOrder.AppendUint32(b, uint32(features))
+}
+
+// parseAgreement reads the version and features agreed on.
+func parseAgreement(b []byte) (version uint8, features Feature) {
+	return b[0], Feature(byteOrder.Uint32(b[1:]))
+}
+
+// setSession records the version and features agreed on for a new session
+// and resets the state the features keep.
+func (c *Connection) setSession(version uint8, features Feature) {
+	c.version = version
+	c.features = features
+	c.compact = compactState{sentSeq: c.compact.sentSeq}
+	c.recvNonces = replayWindow{}
+}
+
+// GetProtocolVersion returns the protocol version agreed on in the handshake,
+// or ProtocolVersion if the connection doesn't have one.
+func (c *Connection) GetProtocolVersion() uint8 {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.version == 0 {
+		return ProtocolVersion
+	}
+	return c.version
+}
+
+// GetFeatures returns the optional features agreed on in the handshake.
+func (c *Connection) GetFeatures() Feature {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.features
+}
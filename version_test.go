@@ -0,0 +1,146 @@
+/* Copyright 2016, Timothy Bogdala <tdb@animal-machine.com>
+   See the LICENSE file for more details. */
+
+package netpeddler
+
+import (
+	"testing"
+	"time"
+)
+
+// versionPair makes a client and a listener requiring a handshake over a
+// MemoryNetwork. The listener's transport is returned so tests can write
+// to it directly.
+func versionPair(t *testing.T) (*Connection, *Connection, *MemoryNetwork) {
+	network := NewMemoryNetwork()
+	listenerConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	clientConn, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	listener := NewTransportConnection(testServerBufferSize, listenerConn, nil)
+	listener.RequireHandshake = true
+	client := NewTransportConnection(testServerBufferSize, clientConn, listenerConn.LocalAddr())
+	return listener, client, network
+}
+
+func TestVersionFeatures(t *testing.T) {
+	listener, client, _ := versionPair(t)
+	defer listener.Close()
+	defer client.Close()
+
+	const compression = FeatureUser
+	const extraSpecial = FeatureUser << 1
+	listener.Features = compression
+	listener.CompactHeaders = true
+	client.Features = compression | extraSpecial
+	client.CompactHeaders = true
+
+	if err := client.Connect(nil); err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	ok := tickUntil(listener, client, time.Second*2, func() bool {
+		return listener.State() == StateConnected && client.State() == StateConnected
+	})
+	if !ok {
+		t.Fatalf("Handshake did not complete (listener: %v, client: %v).", listener.State(), client.State())
+	}
+
+	expected := compression | FeatureCompactHeaders
+	if f := listener.GetFeatures(); f != expected {
+		t.Errorf("Listener agreed on features %x instead of %x.", f, expected)
+	}
+	if f := client.GetFeatures(); f != expected {
+		t.Errorf("Client agreed on features %x instead of %x.", f, expected)
+	}
+	if listener.GetProtocolVersion() != ProtocolVersion || client.GetProtocolVersion() != ProtocolVersion {
+		t.Errorf("Both sides should speak version %d (listener: %d, client: %d).",
+			ProtocolVersion, listener.GetProtocolVersion(), client.GetProtocolVersion())
+	}
+}
+
+func TestVersionIncompatible(t *testing.T) {
+	listener, client, _ := versionPair(t)
+	defer listener.Close()
+	defer client.Close()
+	listener.MinProtocolVersion = ProtocolVersion + 1
+
+	var reason RejectReason
+	client.OnRejected = func(c *Connection, r RejectReason) {
+		reason = r
+	}
+	if err := client.Connect(nil); err != nil {
+		t.Fatalf("Client failed to start the handshake.\n%v", err)
+	}
+	tickUntil(listener, client, time.Second*2, func() bool {
+		return client.State() == StateRejected
+	})
+	if reason != RejectVersion {
+		t.Errorf("Client should have been rejected for its version but got: %v", reason)
+	}
+	if n := listener.GetStats().IncompatibleVersions; n != 1 {
+		t.Errorf("Listener should have counted 1 incompatible version but counted %d.", n)
+	}
+
+	// a client can't ask for a version newer than its own
+	client.MinProtocolVersion = ProtocolVersion + 1
+	if err := client.Connect(nil); err == nil {
+		t.Errorf("Connect should fail when MinProtocolVersion is newer than ProtocolVersion.")
+	}
+}
+
+// TestVersionNewerClient sends connect requests from a client newer than
+// this package and checks that the listener agrees on its own version if
+// the client accepts it.
+func TestVersionNewerClient(t *testing.T) {
+	listener, _, network := versionPair(t)
+	defer listener.Close()
+	future, err := network.Listen("")
+	if err != nil {
+		t.Fatalf("Failed to listen on the memory network.\n%v", err)
+	}
+	defer future.Close()
+
+	tests := []struct {
+		name       string
+		minVersion uint8
+		reply      uint8
+	}{
+		{"accepts older", ProtocolVersion, ctrlChallenge},
+		{"newer only", ProtocolVersion + 1, ctrlReject},
+	}
+	for _, test := range tests {
+		body := append([]byte{ctrlConnectRequest}, make([]byte, cookieSize)...)
+		body = append(body, ProtocolVersion+1, test.minVersion)
+		body = byteOrder.AppendUint32(body, uint32(FeatureCompactHeaders|FeatureUser))
+		b, err := NewPacket(0, 1, ControlChannel, 0, 0, uint32(len(body)), body).MarshalBinary()
+		if err != nil {
+			t.Fatalf("Failed to encode the connect request.\n%v", err)
+		}
+		future.WriteTo(b, listener.ListenAddress)
+		listener.Tick()
+
+		future.SetReadDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, testServerBufferSize)
+		n, _, err := future.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("%s: listener didn't answer the connect request.\n%v", test.name, err)
+		}
+		p, err := DecodePacket(buffer[:n], 0)
+		if err != nil {
+			t.Fatalf("%s: failed to decode the answer.\n%v", test.name, err)
+		}
+		if p.Payload[0] != test.reply {
+			t.Fatalf("%s: listener answered with control message %d instead of %d.", test.name, p.Payload[0], test.reply)
+		}
+		if test.reply == ctrlChallenge {
+			version, features := parseAgreement(p.Payload[1+cookieSize:])
+			if version != ProtocolVersion || features != 0 {
+				t.Errorf("%s: listener agreed on version %d and features %x.", test.name, version, features)
+			}
+		}
+	}
+}